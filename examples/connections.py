@@ -1,10 +1,13 @@
+import os
+
+# set with env or env_file in job files
 CHCON = {
     #'host': 'localhost', # locally
-    'host': 'clickhouse', # docker
-    'port': 8123,
-    'database': 'repeater',
-    'username': 'chuser', 
-    'password': 'password123'
+    'host': os.environ.get('CLICKHOUSE_HOST', 'clickhouse'), # docker
+    'port': int(os.environ.get('CLICKHOUSE_PORT', 8123)),
+    'database': os.environ.get('CLICKHOUSE_DATABASE', 'repeater'),
+    'username': os.environ.get('CLICKHOUSE_USER', 'chuser'),
+    'password': os.environ.get('CLICKHOUSE_PASSWORD', '') # {{secret "clickhouse_password"}} in job env
 }
 # todo: same hostname in docker and host
 # https://stackoverflow.com/questions/47316025/docker-compose-how-to-reference-other-service-as-localhost
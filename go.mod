@@ -1,6 +1,6 @@
 module repeater
 
-go 1.19
+go 1.20
 
 require (
 	github.com/BurntSushi/toml v1.4.0
@@ -8,6 +8,7 @@ require (
 	github.com/golang-jwt/jwt/v5 v5.2.1
 	github.com/lnquy/cron v1.1.1
 	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/crypto v0.14.0
 )
 
 require golang.org/x/sys v0.13.0 // indirect
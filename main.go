@@ -1,31 +1,52 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log" //todo: use log/slog
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	texttemplate "text/template"
 	"time"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
 	"github.com/fsnotify/fsnotify"
 	"github.com/golang-jwt/jwt/v5"
 	hcron "github.com/lnquy/cron"
 	"github.com/robfig/cron/v3"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 //go:embed index.html
@@ -43,21 +64,37 @@ var CONF Config
 
 type JobsAndCron struct {
 	Jobs       map[int]*Job
+	Leader     string
+	Follower   bool
 	cron       *cron.Cron
 	parser     cron.Parser
 	jobCounter int
 	//todo: add config?
-	//no need for mutex?
 	//Jobs is modified from scanAndScheduleJobs only
 	//calls to scanAndScheduleJobs don't overlap
+	//mu guards Jobs against readers in other goroutines
+	mu sync.RWMutex
 }
 
 type Config struct {
-	port     string
-	jobsDir  string
-	password string
-	notify   string
-	logsDir  string
+	port          string
+	jobsDir       string
+	password      string
+	notify        string
+	logsDir       string
+	stateDir      string
+	webhookToken  string
+	workerToken   string
+	sshKey        string
+	sshKnownHosts string
+	ha            bool
+	instanceId    string
+	leaseDuration time.Duration
+	shutdownGrace time.Duration
+	adoptTasks    bool
+	secretsFile   string
+	masterKey     string
+	masterKeyFile string
 }
 
 type RunStatus int
@@ -67,31 +104,159 @@ const (
 	RunFailure
 	Running
 	NoRun
+	Waiting
+	Skipped
+	UpstreamFailed
+	FailedAllowed
+	SuccessWithWarnings
+	WaitingRetry
+	Interrupted
 )
 
 type Task struct {
-	Name       string   `toml:"name"`
-	Cmd        string   `toml:"cmd"`
-	Emails     []string `toml:"emails"`
-	Retries    int      `toml:"retries"`
-	TimeoutSec int      `toml:"timeout"`
+	Name               string              `toml:"name"`
+	Cmd                string              `toml:"cmd"`
+	Args               []string            `toml:"args"`
+	Shell              string              `toml:"shell"`
+	Script             string              `toml:"script"`
+	Interpreter        string              `toml:"interpreter"`
+	WorkerLabels       map[string]string   `toml:"worker_labels"`
+	Host               string              `toml:"host"`
+	SSHUser            string              `toml:"ssh_user"`
+	Emails             []string            `toml:"emails"`
+	Retries            int                 `toml:"retries"`
+	TimeoutSec         int                 `toml:"timeout"`
+	DependsOn          []string            `toml:"depends_on"`
+	TriggerRule        string              `toml:"trigger_rule"`
+	AllowFailure       bool                `toml:"allow_failure"`
+	Branches           map[string][]string `toml:"branches"`
+	Foreach            []string            `toml:"foreach"`
+	ForeachCmd         string              `toml:"foreach_cmd"`
+	MaxParallel        int                 `toml:"max_parallel"`
+	Job                string              `toml:"job"`
+	RetryDelaySec      int                 `toml:"retry_delay"`
+	RetryBackoff       float64             `toml:"retry_backoff"`
+	MaxRetryDelaySec   int                 `toml:"max_retry_delay"`
+	RetryOnExitCodes   []int               `toml:"retry_on_exit_codes"`
+	RetryOnOutput      string              `toml:"retry_on_output"`
+	NoRetryOnExitCodes []int               `toml:"no_retry_on_exit_codes"`
+	NoRetryOnOutput    string              `toml:"no_retry_on_output"`
+	retryOn            *retryConditions
+	SensorCmd          string            `toml:"sensor_cmd"`
+	SensorFile         string            `toml:"sensor_file"`
+	SensorHTTP         string            `toml:"sensor_http"`
+	PokeIntervalSec    int               `toml:"poke_interval"`
+	SensorTimeoutSec   int               `toml:"sensor_timeout"`
+	SensorOnTimeout    string            `toml:"sensor_on_timeout"`
+	Env                map[string]string `toml:"env" json:"-"`
+	EnvFile            string            `toml:"env_file"`
+	Workdir            string            `toml:"workdir"`
+	RunAs              string            `toml:"run_as"`
+	Limits             Limits            `toml:"limits"`
+}
+
+// Limits of task processes, zero values mean no limit.
+type Limits struct {
+	Memory     string `toml:"memory"`
+	CPUSeconds int    `toml:"cpu_seconds"`
+	Nofile     int    `toml:"nofile"`
+}
+
+type retryConditions struct {
+	exitCodes   []int
+	output      *regexp.Regexp
+	noExitCodes []int
+	noOutput    *regexp.Regexp
+}
+
+type TaskAttempt struct {
+	Attempt       int
+	StartTime     time.Time
+	EndTime       time.Time
+	Status        RunStatus
+	ExitCode      int
+	Retry         bool
+	RetryReason   string
+	FailureReason string
 }
 
 type TaskRun struct {
 	Idx               int
 	Name              string
+	jobTitle          string
 	cmd               string
 	RenderedCmd       string
 	StartTime         time.Time
 	EndTime           time.Time
 	Status            RunStatus
 	Attempt           int
-	cmdTemplateParams map[string]string
+	cmdTemplateParams map[string]interface{}
 	emails            []string
 	retries           int
 	timeout           int
 	ctxCancelFn       context.CancelFunc
-	logfile           string
+	Logfile           string
+	deps              []int
+	triggerRule       string
+	allowFailure      bool
+	branches          map[string][]string
+	ExitCode          int
+	Branch            string
+	sensor            *sensor
+	Pokes             int
+	foreach           []string
+	foreachCmd        string
+	maxParallel       int
+	Item              string
+	Items             []*TaskRun
+	jobRun            *JobRun
+	subJob            string
+	SubJobRun         *jobRunRef
+	retryDelay        int
+	retryBackoff      float64
+	maxRetryDelay     int
+	NextAttempt       time.Time
+	retryOn           *retryConditions
+	Attempts          []*TaskAttempt
+	output            string
+	Outputs           map[string]string
+	env               map[string]string
+	envFiles          []string
+	workdir           string
+	jobDir            string
+	Env               map[string]string
+	Workdir           string
+	secrets           []string
+	limits            *procLimits
+	FailureReason     string
+	args              []string
+	shell             string
+	executor          Executor
+	script            string
+	interpreter       string
+	RenderedScript    string
+	workerLabels      map[string]string
+	host              string
+	sshUser           string
+	interrupted       bool
+	Process           *taskProcess
+}
+
+// jobRunRef points to the run started by a job task.
+// Ids change on reloads, the run is found by the job title and the file it's saved to.
+type jobRunRef struct {
+	JobId  int
+	RunIdx int
+	Job    string
+	File   string
+}
+
+type sensor struct {
+	kind         string
+	target       string
+	pokeInterval int
+	timeout      int
+	onTimeout    string
 }
 
 type JobRun struct {
@@ -103,45 +268,260 @@ type JobRun struct {
 	Status        RunStatus
 	TasksHistory  []*TaskRun
 	ctxCancelFn   context.CancelFunc
+	depth         int
+	params        map[string]interface{}
+	resumed       bool
+	state         *runState
+	// outputsMu guards Outputs of the tasks, published and read by the goroutines of the tasks
+	outputsMu sync.Mutex
 }
 
 type Job struct {
-	Id             int
-	file           string
-	md5            [16]byte
-	Title          string `toml:"title"`
-	Cron           string `toml:"cron"`
-	HCron          string
-	Listens        []string   `toml:"listens"`
-	Tasks          []*Task    `toml:"tasks"`
-	Order          [][]string `toml:"order"`
-	OrderProvided  bool       `toml:"-"`
-	taskMap        map[string]*Task
-	cronID         cron.EntryID
-	RunHistory     []*JobRun
-	OnOff          bool
-	NextScheduled  time.Time
-	Retries        int      `toml:"retries"`
-	TaskTimeoutSec int      `toml:"task_timeout"`
-	Emails         []string `toml:"emails"`
+	Id               int
+	file             string
+	md5              [16]byte
+	baseFiles        []string
+	config           map[string]interface{}
+	Title            string `toml:"title"`
+	Cron             string `toml:"cron"`
+	HCron            string
+	Listens          []string   `toml:"listens"`
+	Tasks            []*Task    `toml:"tasks"`
+	Order            [][]string `toml:"order"`
+	OrderProvided    bool       `toml:"-"`
+	taskMap          map[string]*Task
+	taskDeps         [][]int
+	cronID           cron.EntryID
+	stateModTime     time.Time
+	RunHistory       []*JobRun
+	OnOff            bool
+	NextScheduled    time.Time
+	Retries          int               `toml:"retries"`
+	TaskTimeoutSec   int               `toml:"task_timeout"`
+	Emails           []string          `toml:"emails"`
+	Watch            []string          `toml:"watch"`
+	WatchMinAgeSec   int               `toml:"watch_min_age"`
+	WebhookToken     string            `toml:"webhook_token" json:"-"`
+	RetryDelaySec    int               `toml:"retry_delay"`
+	RetryBackoff     float64           `toml:"retry_backoff"`
+	MaxRetryDelaySec int               `toml:"max_retry_delay"`
+	Env              map[string]string `toml:"env" json:"-"`
+	EnvFile          string            `toml:"env_file"`
+	Workdir          string            `toml:"workdir"`
+	RunAs            string            `toml:"run_as"`
+	Limits           Limits            `toml:"limits"`
+	Shell            string            `toml:"shell"`
+	WorkerLabels     map[string]string `toml:"worker_labels"`
+	Host             string            `toml:"host"`
+	SSHUser          string            `toml:"ssh_user"`
+	Matrix           map[string]interface{} `toml:"-"`
+}
+
+// webhookRun is a run started with an idempotency key.
+// The run is found by its start time, indexes change when the history is trimmed.
+type webhookRun struct {
+	RunStart time.Time
+	Created  time.Time
 }
 
+// maxWebhookKeys is the number of idempotency keys kept for each job.
+const maxWebhookKeys = 1000
+
 func main() {
 	initConfig()
+	if len(os.Args) > 1 && os.Args[1] == "secrets" {
+		os.Exit(secretsCmd(os.Args[2:]))
+	}
 	jwtSecretKey = generateRandomKey(32)
 	infoLog = log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
 	errorLog = log.New(os.Stdout, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
 	webLog = log.New(&webLogBuf, "", log.Ldate|log.Ltime)
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		os.Exit(workerCmd(os.Args[2:]))
+	}
 	JC = JobsAndCron{
 		Jobs:       make(map[int]*Job),
 		parser:     cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow),
 		jobCounter: 0,
 	}
 	JC.cron = cron.New(cron.WithParser(JC.parser))
-	JC.cron.Start()
+	JC.Follower = CONF.ha
 	scanAndScheduleJobs()
+	loadWebhookKeys()
+	// the leader resumes the runs of the scanned jobs
+	if CONF.ha {
+		go electLeader()
+	} else {
+		JC.cron.Start()
+		resumeRuns()
+	}
 	go watchFS()
-	httpServer()
+	go watchTriggerFiles()
+	srv := httpServer()
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	infoLog.Printf("Received %v, shutting down", <-sig)
+	shutdown(srv, sig)
+}
+
+// activeRuns tracks the runs started by the process so that shutdown can drain them.
+type activeRuns struct {
+	runs     map[*JobRun]bool
+	stopping bool
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+}
+
+var ACTIVERUNS = &activeRuns{
+	runs: make(map[*JobRun]bool),
+}
+
+// add registers a run unless the process is shutting down.
+func (a *activeRuns) add(run *JobRun) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopping {
+		return false
+	}
+	a.runs[run] = true
+	a.wg.Add(1)
+	return true
+}
+
+func (a *activeRuns) done(run *JobRun) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.runs, run)
+	a.wg.Done()
+}
+
+func (a *activeRuns) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopping = true
+}
+
+func (a *activeRuns) isStopping() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stopping
+}
+
+// wait returns true when all runs are done before the timeout or a signal.
+func (a *activeRuns) wait(timeout time.Duration, sig chan os.Signal) bool {
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case s := <-sig:
+		infoLog.Printf("Received %v, not waiting for active runs", s)
+	case <-time.After(timeout):
+	}
+	return false
+}
+
+// interrupt cancels the active runs. Tasks that were active end as interrupted.
+func (a *activeRuns) interrupt() []*JobRun {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var runs []*JobRun
+	for run := range a.runs {
+		interruptRun(run)
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// interruptRun flags the active tasks of the run and of the runs started by its job tasks, then cancels them.
+func interruptRun(run *JobRun) {
+	for _, tr := range run.TasksHistory {
+		if isActive(tr.Status) {
+			tr.interrupted = true
+			if sub := subJobRun(tr); sub != nil {
+				interruptRun(sub)
+			}
+		}
+		for _, item := range tr.Items {
+			item.interrupted = isActive(item.Status)
+		}
+		if tr.ctxCancelFn != nil {
+			tr.ctxCancelFn()
+		}
+	}
+	if run.ctxCancelFn != nil {
+		run.ctxCancelFn()
+	}
+}
+
+// shutdown stops scheduling, waits for active runs up to the grace period,
+// then interrupts the remaining ones, or leaves them to the next start when tasks are adopted,
+// saves the state and stops the web server.
+func shutdown(srv *http.Server, sig chan os.Signal) {
+	JC.cron.Stop()
+	ACTIVERUNS.stop()
+	if !ACTIVERUNS.wait(CONF.shutdownGrace, sig) {
+		if CONF.adoptTasks {
+			infoLog.Printf("Leaving active runs to the next start")
+		} else {
+			runs := ACTIVERUNS.interrupt()
+			infoLog.Printf("Interrupting %d active runs", len(runs))
+			// tasks are killed with their process groups, remote ones may take longer
+			ACTIVERUNS.wait(10*time.Second, sig)
+			for _, run := range runs {
+				markInterrupted(run)
+			}
+		}
+	}
+	if CONF.ha && isLeader() {
+		if err := releaseLease(); err != nil {
+			errorLog.Printf("Failed to release the leader lease: %v", err)
+		}
+	}
+	generateEvent("jobs_updated", nil, nil)
+	closeSSEClients()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		errorLog.Printf("Failed to shut down the web server: %v", err)
+	}
+	infoLog.Printf("Shut down")
+}
+
+// markInterrupted sets the interrupted status to the run and its tasks flagged by interruptRun, once they stopped.
+func markInterrupted(run *JobRun) {
+	for _, tr := range run.TasksHistory {
+		if sub := subJobRun(tr); sub != nil && tr.interrupted {
+			markInterrupted(sub)
+		}
+		for _, item := range tr.Items {
+			if item.interrupted {
+				item.Status = Interrupted
+				item.FailureReason = "interrupted by shutdown"
+			}
+		}
+		if tr.interrupted {
+			tr.Status = Interrupted
+			tr.FailureReason = "interrupted by shutdown"
+			if tr.EndTime.IsZero() {
+				tr.EndTime = time.Now()
+			}
+		}
+	}
+	run.Status = Interrupted
+	if run.EndTime.IsZero() {
+		run.EndTime = time.Now()
+	}
+	snapshotRun(run)
+	saveRun(run)
 }
 
 func initConfig() {
@@ -150,6 +530,7 @@ func initConfig() {
 	CONF.password = ""
 	CONF.notify = "python3 ./examples/notify.py"
 	CONF.logsDir = "/tmp/repeater/"
+	CONF.stateDir = "/tmp/repeater/state/"
 	if port := os.Getenv("REPEATER_PORT"); port != "" {
 		CONF.port = port
 	}
@@ -157,12 +538,222 @@ func initConfig() {
 		CONF.jobsDir = jobsDir
 	}
 	CONF.password = os.Getenv("REPEATER_PASSWORD")
+	CONF.webhookToken = os.Getenv("REPEATER_WEBHOOK_TOKEN")
+	CONF.workerToken = os.Getenv("REPEATER_WORKER_TOKEN")
+	home, _ := os.UserHomeDir()
+	CONF.sshKey = filepath.Join(home, ".ssh", "id_ed25519")
+	if sshKey := os.Getenv("REPEATER_SSH_KEY"); sshKey != "" {
+		CONF.sshKey = sshKey
+	}
+	CONF.sshKnownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	if sshKnownHosts := os.Getenv("REPEATER_SSH_KNOWN_HOSTS"); sshKnownHosts != "" {
+		CONF.sshKnownHosts = sshKnownHosts
+	}
 	if notify := os.Getenv("REPEATER_NOTIFY"); notify != "" {
 		CONF.notify = notify
 	}
 	if logsDir := os.Getenv("REPEATER_LOGS_DIRECTORY"); logsDir != "" {
 		CONF.logsDir = logsDir
 	}
+	if stateDir := os.Getenv("REPEATER_STATE_DIRECTORY"); stateDir != "" {
+		CONF.stateDir = stateDir
+	}
+	CONF.secretsFile = filepath.Join(CONF.stateDir, "secrets")
+	if secretsFile := os.Getenv("REPEATER_SECRETS_FILE"); secretsFile != "" {
+		CONF.secretsFile = secretsFile
+	}
+	CONF.masterKey = os.Getenv("REPEATER_MASTER_KEY")
+	CONF.masterKeyFile = os.Getenv("REPEATER_MASTER_KEY_FILE")
+	CONF.ha, _ = strconv.ParseBool(os.Getenv("REPEATER_HA"))
+	hostname, _ := os.Hostname()
+	CONF.instanceId = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	if instanceId := os.Getenv("REPEATER_INSTANCE_ID"); instanceId != "" {
+		CONF.instanceId = instanceId
+	}
+	CONF.leaseDuration = 30 * time.Second
+	if lease, err := strconv.Atoi(os.Getenv("REPEATER_HA_LEASE")); err == nil && lease > 0 {
+		CONF.leaseDuration = time.Duration(lease) * time.Second
+	}
+	CONF.adoptTasks, _ = strconv.ParseBool(os.Getenv("REPEATER_ADOPT_TASKS"))
+	CONF.shutdownGrace = 30 * time.Second
+	if grace, err := strconv.Atoi(os.Getenv("REPEATER_SHUTDOWN_GRACE")); err == nil && grace >= 0 {
+		CONF.shutdownGrace = time.Duration(grace) * time.Second
+	}
+}
+
+type secretsStore struct {
+	values  map[string]string
+	modTime time.Time
+	mu      sync.Mutex
+}
+
+var SECRETS = &secretsStore{}
+
+// secretsCmd implements the secrets subcommands and returns the exit code.
+func secretsCmd(args []string) int {
+	usage := "usage: repeater secrets set NAME [VALUE] | get NAME | list | delete NAME | genkey\n" +
+		"set reads the value from stdin if it is not given"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	if args[0] == "genkey" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to generate a key:", err)
+			return 1
+		}
+		fmt.Println(base64.StdEncoding.EncodeToString(key))
+		return 0
+	}
+	values, err := readSecretsFile()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return 0
+	case args[0] == "get" && len(args) == 2:
+		value, ok := values[args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "secret '%s' not found\n", args[1])
+			return 1
+		}
+		fmt.Println(value)
+		return 0
+	case args[0] == "set" && (len(args) == 2 || len(args) == 3):
+		value := ""
+		if len(args) == 3 {
+			value = args[2]
+		} else {
+			value, err = bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && err != io.EOF {
+				fmt.Fprintln(os.Stderr, "Failed to read the value:", err)
+				return 1
+			}
+			value = strings.TrimRight(value, "\r\n")
+		}
+		values[args[1]] = value
+	case args[0] == "delete" && len(args) == 2:
+		if _, ok := values[args[1]]; !ok {
+			fmt.Fprintf(os.Stderr, "secret '%s' not found\n", args[1])
+			return 1
+		}
+		delete(values, args[1])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	if err := writeSecretsFile(values); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// secretsCipher returns AES-GCM with a key derived from the master key
+// in REPEATER_MASTER_KEY or the file in REPEATER_MASTER_KEY_FILE.
+func secretsCipher() (cipher.AEAD, error) {
+	masterKey := CONF.masterKey
+	if masterKey == "" && CONF.masterKeyFile != "" {
+		data, err := os.ReadFile(CONF.masterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %v", err)
+		}
+		masterKey = string(data)
+	}
+	masterKey = strings.TrimSpace(masterKey)
+	if masterKey == "" {
+		return nil, errors.New("no master key, set REPEATER_MASTER_KEY or REPEATER_MASTER_KEY_FILE")
+	}
+	key := sha256.Sum256([]byte(masterKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readSecretsFile decrypts the secrets file. A missing file has no secrets.
+func readSecretsFile() (map[string]string, error) {
+	values := make(map[string]string)
+	data, err := os.ReadFile(CONF.secretsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return values, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %v", err)
+	}
+	gcm, err := secretsCipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("secrets file is corrupted")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt secrets file, wrong master key?")
+	}
+	if err := json.Unmarshal(plain, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file: %v", err)
+	}
+	return values, nil
+}
+
+func writeSecretsFile(values map[string]string) error {
+	gcm, err := secretsCipher()
+	if err != nil {
+		return err
+	}
+	plain, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(CONF.secretsFile), 0700); err != nil {
+		return fmt.Errorf("failed to create secrets directory: %v", err)
+	}
+	tmp := CONF.secretsFile + ".tmp"
+	if err := os.WriteFile(tmp, gcm.Seal(nonce, nonce, plain, nil), 0600); err != nil {
+		return fmt.Errorf("failed to write secrets file: %v", err)
+	}
+	return os.Rename(tmp, CONF.secretsFile)
+}
+
+// get returns a secret, rereading the secrets file when it has changed.
+func (s *secretsStore) get(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, err := os.Stat(CONF.secretsFile)
+	if err != nil {
+		return "", fmt.Errorf("secret '%s' not found", name)
+	}
+	if s.values == nil || !info.ModTime().Equal(s.modTime) {
+		values, err := readSecretsFile()
+		if err != nil {
+			errorLog.Printf("Failed to load secrets: %v", err)
+			return "", err
+		}
+		s.values = values
+		s.modTime = info.ModTime()
+	}
+	value, ok := s.values[name]
+	if !ok {
+		return "", fmt.Errorf("secret '%s' not found", name)
+	}
+	return value, nil
 }
 
 func generateRandomKey(size int) []byte {
@@ -185,6 +776,7 @@ func watchFS() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	watchBaseFileDirs(watcher)
 	for {
 		select {
 		case _, ok := <-watcher.Events:
@@ -192,6 +784,7 @@ func watchFS() {
 				return
 			}
 			scanAndScheduleJobs()
+			watchBaseFileDirs(watcher)
 			//todo: avoid full rescan on each event
 			//todo: debounce
 		case err, ok := <-watcher.Errors:
@@ -203,824 +796,5078 @@ func watchFS() {
 	}
 }
 
-func scanAndScheduleJobs() {
-	files := make(map[string][16]byte)
-	err := scanFiles(files)
-	webLogBuf.Reset()
+// watchBaseFileDirs adds directories of the files jobs extend to the watcher,
+// so that a change to a base file reloads the jobs that depend on it.
+func watchBaseFileDirs(watcher *fsnotify.Watcher) {
+	for _, jb := range loadedJobs() {
+		for _, f := range jb.baseFiles {
+			if err := watcher.Add(filepath.Dir(f)); err != nil {
+				errorLog.Printf("fsnotify: failed to watch %s: %v", filepath.Dir(f), err)
+			}
+		}
+	}
+}
+
+type fileTriggers struct {
+	watcher   *fsnotify.Watcher
+	dirs      map[string]bool
+	pending   map[string]*time.Timer
+	processed map[string]map[string]time.Time
+	mu        sync.Mutex
+}
+
+var FILETRIGGERS = &fileTriggers{
+	dirs:      make(map[string]bool),
+	pending:   make(map[string]*time.Timer),
+	processed: make(map[string]map[string]time.Time),
+}
+
+func watchTriggerFiles() {
+	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
-		errorLog.Printf("Errors while reading files: %s", err)
-		webLog.Printf("Errors while reading files: %s", err)
+		log.Fatal(err)
 	}
-	removeJobsWithoutFiles(files)
-	for f := range files {
-		infoLog.Printf("Loading %s", f)
-		jb, err := processJobFile(f)
-		if jb != nil && err == nil {
-			scheduleJob(jb)
-		} else {
-			infoLog.Printf("Skipping %s", f)
+	defer watcher.Close()
+	loadProcessedTriggerFiles()
+	FILETRIGGERS.mu.Lock()
+	FILETRIGGERS.watcher = watcher
+	FILETRIGGERS.mu.Unlock()
+	updateTriggerWatches()
+	// jobs restored as on pick up the files that arrived while Repeater was stopped
+	for _, jb := range loadedJobs() {
+		scanWatchedFiles(jb)
+	}
+	for {
+		select {
+		case ev, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write) {
+				matchTriggerFile(ev.Name, nil)
+			} else if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+				forgetTriggerFile(ev.Name)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			errorLog.Println("fsnotify:", err)
 		}
 	}
-	generateEvent("jobs_updated", nil, nil)
 }
 
-func scanFiles(files map[string][16]byte) error {
-	err := filepath.Walk(CONF.jobsDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			errorLog.Printf("Error accessing path %s: %v\n", path, err)
-			return err
+func updateTriggerWatches() {
+	dirs := make(map[string]bool)
+	for _, jb := range loadedJobs() {
+		for _, pattern := range jb.Watch {
+			dirs[filepath.Dir(pattern)] = true
 		}
-		if !info.IsDir() && filepath.Ext(path) == ".job" {
-			f, err := os.ReadFile(path)
-			if err != nil {
-				errorLog.Printf("Error reading file %s: %v\n", path, err)
-				return err
-			}
-			files[path] = md5.Sum(f)
+	}
+	FILETRIGGERS.mu.Lock()
+	defer FILETRIGGERS.mu.Unlock()
+	if FILETRIGGERS.watcher == nil {
+		return
+	}
+	for d := range FILETRIGGERS.dirs {
+		if !dirs[d] {
+			FILETRIGGERS.watcher.Remove(d)
+			delete(FILETRIGGERS.dirs, d)
 		}
-		return nil
-	})
-	return err
+	}
+	for d := range dirs {
+		if FILETRIGGERS.dirs[d] {
+			continue
+		}
+		if err := FILETRIGGERS.watcher.Add(d); err != nil {
+			errorLog.Printf("Can't watch directory %s: %v", d, err)
+			webLog.Printf("Can't watch directory %s: %v", d, err)
+			continue
+		}
+		FILETRIGGERS.dirs[d] = true
+	}
 }
 
-func removeJobsWithoutFiles(files map[string][16]byte) {
-	var toremove []int
-	for id, jb := range JC.Jobs {
-		md5, haskey := files[jb.file]
-		if !haskey {
-			infoLog.Printf("Marking %s for deletion", jb.Title)
-			toremove = append(toremove, id)
-		} else if md5 != jb.md5 {
-			infoLog.Printf("File %s has changed, marking for reloading", jb.file)
-			toremove = append(toremove, id)
-		} else if md5 == jb.md5 {
-			infoLog.Printf("File %s has not changed, skipping", jb.file)
-			delete(files, jb.file)
-		} else {
-			panic("This is not supposed to happen")
+func scanWatchedFiles(jb *Job) {
+	for _, pattern := range jb.Watch {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			matchTriggerFile(path, jb)
 		}
 	}
-	for _, id := range toremove {
-		JC.cron.Remove(JC.Jobs[id].cronID)
-		cancelActiveJobRuns(JC.Jobs[id])
-		delete(JC.Jobs, id)
+}
+
+// matchTriggerFile (re)starts the debounce timer for every enabled job
+// watching the path. If jb is not nil, only jb is checked.
+// JC.mu is held so that jobs aren't reloaded meanwhile, it's taken before FILETRIGGERS.mu.
+func matchTriggerFile(path string, jb *Job) {
+	JC.mu.RLock()
+	defer JC.mu.RUnlock()
+	FILETRIGGERS.mu.Lock()
+	defer FILETRIGGERS.mu.Unlock()
+	for _, j := range JC.Jobs {
+		if jb != nil && j != jb {
+			continue
+		}
+		if !j.OnOff || !watchMatches(j, path) {
+			continue
+		}
+		if _, done := FILETRIGGERS.processed[j.Title][path]; done {
+			continue
+		}
+		key := j.Title + "\x00" + path
+		delay := time.Duration(watchMinAge(j)) * time.Second
+		if timer, ok := FILETRIGGERS.pending[key]; ok {
+			timer.Reset(delay)
+			continue
+		}
+		title := j.Title
+		FILETRIGGERS.pending[key] = time.AfterFunc(delay, func() { checkTriggerFile(title, path) })
 	}
 }
 
-func processJobFile(filePath string) (*Job, error) {
-	var jb Job
-	jb.file = filePath
-	jb.OnOff = false
-	f, err := os.ReadFile(filePath)
-	if err != nil {
-		errorLog.Printf("Error reading file %s: %v\n", filePath, err)
-		webLog.Printf("Error reading file %s: %v\n", filePath, err)
-		return nil, err
+func watchMatches(jb *Job, path string) bool {
+	for _, pattern := range jb.Watch {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
 	}
-	jb.md5 = md5.Sum(f)
-	jb.RunHistory = make([]*JobRun, 0)
-	err = toml.Unmarshal(f, &jb)
-	if err != nil {
-		errorLog.Printf("Error parsing file %s: %v\n", filePath, err)
-		webLog.Printf("Error parsing file %s: %v\n", filePath, err)
-		return nil, err
+	return false
+}
+
+func watchMinAge(jb *Job) int {
+	if jb.WatchMinAgeSec == 0 {
+		return 5
 	}
-	if jb.Title == "" {
-		errorLog.Printf("%s: missing job title. Skipping.\n", filePath)
-		webLog.Printf("%s: missing job title. Skipping. \n", filePath)
-		return nil, nil
+	return jb.WatchMinAgeSec
+}
+
+func checkTriggerFile(title string, path string) {
+	JC.mu.RLock()
+	defer JC.mu.RUnlock()
+	FILETRIGGERS.mu.Lock()
+	defer FILETRIGGERS.mu.Unlock()
+	key := title + "\x00" + path
+	jb := jobByTitle(title)
+	info, err := os.Stat(path)
+	if jb == nil || !jb.OnOff || err != nil || info.IsDir() || !isLeader() {
+		delete(FILETRIGGERS.pending, key)
+		return
 	}
-	if len(jb.Tasks) == 0 {
-		errorLog.Printf("%s: no tasks. Skipping.\n", filePath)
-		webLog.Printf("%s: no tasks. Skipping. \n", filePath)
-		return nil, nil
+	minAge := time.Duration(watchMinAge(jb)) * time.Second
+	if age := time.Since(info.ModTime()); age < minAge {
+		FILETRIGGERS.pending[key].Reset(minAge - age)
+		return
 	}
-	taskNames := make(map[string]bool)
-	for _, t := range jb.Tasks {
-		if len(t.Name) == 0 || len(t.Cmd) == 0 {
-			errorLog.Printf("%s: Task name or cmd is empty. Skipping job altogether.\n", filePath)
-			webLog.Printf("%s: Task name or cmd is empty. Skipping job altogether. \n", filePath)
-			return nil, nil
-		}
-		if taskNames[t.Name] {
-			errorLog.Printf("%s: Duplicate task name '%s'. Skipping job altogether.\n", filePath, t.Name)
-			webLog.Printf("%s: Duplicate task name '%s'. Skipping job altogether.\n", filePath, t.Name)
-			return nil, fmt.Errorf("duplicate task name '%s'", t.Name)
-		} else {
-			taskNames[t.Name] = true
+	delete(FILETRIGGERS.pending, key)
+	if _, done := FILETRIGGERS.processed[title][path]; done {
+		return
+	}
+	if FILETRIGGERS.processed[title] == nil {
+		FILETRIGGERS.processed[title] = make(map[string]time.Time)
+	}
+	FILETRIGGERS.processed[title][path] = time.Now()
+	saveProcessedTriggerFiles()
+	infoLog.Printf("Triggering job '%s' on file '%s'", title, path)
+	go runNow(jb, map[string]interface{}{"trigger_file": path})
+}
+
+func triggerFilesStatePath() string {
+	return filepath.Join(CONF.stateDir, "trigger_files.json")
+}
+
+func loadProcessedTriggerFiles() {
+	FILETRIGGERS.mu.Lock()
+	defer FILETRIGGERS.mu.Unlock()
+	data, err := os.ReadFile(triggerFilesStatePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		errorLog.Printf("Failed to read processed trigger files: %v", err)
+		return
+	}
+	if err := json.Unmarshal(data, &FILETRIGGERS.processed); err != nil {
+		errorLog.Printf("Failed to parse processed trigger files: %v", err)
+	}
+	forgetMissingTriggerFiles()
+}
+
+// forgetTriggerFile is called when a file is deleted or renamed,
+// so that a file created again at the same path triggers again.
+func forgetTriggerFile(path string) {
+	FILETRIGGERS.mu.Lock()
+	defer FILETRIGGERS.mu.Unlock()
+	forgotten := false
+	for title, files := range FILETRIGGERS.processed {
+		if _, ok := files[path]; ok {
+			delete(files, path)
+			forgotten = true
+		}
+		if len(files) == 0 {
+			delete(FILETRIGGERS.processed, title)
 		}
 	}
-	if jb.Retries < 0 {
-		errorLog.Printf("Job '%s' has negative retries (%d), setting to 0", jb.Title, jb.Retries)
-		webLog.Printf("Job '%s' has negative retries (%d), setting to 0", jb.Title, jb.Retries)
-		jb.Retries = 0
+	if forgotten {
+		saveProcessedTriggerFiles()
 	}
-	for _, t := range jb.Tasks {
-		if t.Retries < 0 {
-			errorLog.Printf("Task '%s' in job '%s' has negative retries (%d), setting to 0", t.Name, jb.Title, t.Retries)
-			webLog.Printf("Task '%s' in job '%s' has negative retries (%d), setting to 0", t.Name, jb.Title, t.Retries)
-			t.Retries = 0
+}
+
+// forgetMissingTriggerFiles forgets the files deleted while they weren't watched.
+// It expects FILETRIGGERS.mu to be held.
+func forgetMissingTriggerFiles() {
+	for title, files := range FILETRIGGERS.processed {
+		for path := range files {
+			if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+				delete(files, path)
+			}
+		}
+		if len(files) == 0 {
+			delete(FILETRIGGERS.processed, title)
 		}
 	}
-	if jb.TaskTimeoutSec < 0 {
-		errorLog.Printf("Job '%s' has negative task_timeout (%d), setting to 0", jb.Title, jb.TaskTimeoutSec)
-		webLog.Printf("Job '%s' has negative task_timeout (%d), setting to 0", jb.Title, jb.TaskTimeoutSec)
-		jb.TaskTimeoutSec = 0
+}
+
+// saveProcessedTriggerFiles expects FILETRIGGERS.mu to be held.
+// Files that no longer exist are forgotten.
+func saveProcessedTriggerFiles() {
+	forgetMissingTriggerFiles()
+	data, err := json.Marshal(FILETRIGGERS.processed)
+	if err != nil {
+		errorLog.Printf("Failed to serialize processed trigger files: %v", err)
+		return
 	}
-	for _, t := range jb.Tasks {
-		if t.TimeoutSec < 0 {
-			errorLog.Printf("Task '%s' in job '%s' has negative timeout (%d), setting to 0", t.Name, jb.Title, t.TimeoutSec)
-			webLog.Printf("Task '%s' in job '%s' has negative timeout (%d), setting to 0", t.Name, jb.Title, t.TimeoutSec)
-			t.TimeoutSec = 0
+	if err := os.MkdirAll(CONF.stateDir, 0755); err != nil {
+		errorLog.Printf("Failed to create state directory %s: %v", CONF.stateDir, err)
+		return
+	}
+	if err := os.WriteFile(triggerFilesStatePath(), data, 0644); err != nil {
+		errorLog.Printf("Failed to save processed trigger files: %v", err)
+	}
+}
+
+// jobState is the part of a job kept in the state directory besides its runs.
+type jobState struct {
+	OnOff bool
+}
+
+// savedRun is a run as saved to its file. Runs are rebuilt from the current job definition and the saved fields.
+type savedRun struct {
+	*JobRun
+	Params       map[string]interface{}
+	Depth        int `json:",omitempty"`
+	TasksHistory []json.RawMessage
+}
+
+// savedTask is a task of a saved run, with its items serialized separately.
+type savedTask struct {
+	*TaskRun
+	Items []json.RawMessage
+}
+
+// runState holds the serialized parts of a run. Each part is serialized by the goroutine
+// that changes it, so that saving the run doesn't read tasks while they run.
+type runState struct {
+	mu    sync.Mutex
+	title string
+	file  string
+	tasks []*TaskRun
+	run   []byte
+	parts map[*TaskRun]*taskState
+	saved bool
+}
+
+type taskState struct {
+	data  []byte
+	items []*TaskRun
+}
+
+// maxSavedRuns is the number of the latest runs of a job kept in the state directory.
+const maxSavedRuns = 100
+
+func jobStateDir(title string) string {
+	return filepath.Join(CONF.stateDir, "jobs", url.PathEscape(title))
+}
+
+// saveJobState writes the on/off state of the job.
+// Only the leader saves the state.
+func saveJobState(jb *Job) {
+	if !isLeader() {
+		return
+	}
+	data, err := json.Marshal(jobState{OnOff: jb.OnOff})
+	if err != nil {
+		errorLog.Printf("Failed to serialize state of '%s': %v", jb.Title, err)
+		return
+	}
+	if err := writeFileAtomic(filepath.Join(jobStateDir(jb.Title), "job.json"), data); err != nil {
+		errorLog.Printf("Failed to save state of '%s': %v", jb.Title, err)
+	}
+}
+
+// snapshotRun serializes the run and all its tasks.
+// It's called by the goroutine running the run while none of its tasks runs.
+func snapshotRun(run *JobRun) {
+	data, err := json.Marshal(savedRun{JobRun: run, Params: run.params, Depth: run.depth})
+	if err != nil {
+		errorLog.Printf("Failed to serialize run %d of '%s': %v", run.Idx, run.state.title, err)
+		return
+	}
+	run.state.mu.Lock()
+	run.state.run = data
+	run.state.mu.Unlock()
+	for _, tr := range run.state.tasks {
+		snapshotTask(run, tr)
+	}
+}
+
+// snapshotTask serializes a task, with its items if it's a task of the run.
+// It's called by the goroutine running the task.
+func snapshotTask(run *JobRun, tr *TaskRun) {
+	parts := make(map[*TaskRun]*taskState)
+	task := &taskState{items: append([]*TaskRun(nil), tr.Items...)}
+	parts[tr] = task
+	for _, item := range task.items {
+		parts[item] = &taskState{}
+	}
+	for t, part := range parts {
+		data, err := json.Marshal(savedTask{TaskRun: t})
+		if err != nil {
+			errorLog.Printf("Failed to serialize task '%s' of '%s': %v", t.Name, run.state.title, err)
+			return
 		}
+		part.data = data
 	}
-	jb.taskMap = make(map[string]*Task)
-	for _, t := range jb.Tasks {
-		jb.taskMap[t.Name] = t
+	run.state.mu.Lock()
+	defer run.state.mu.Unlock()
+	if run.state.parts == nil {
+		run.state.parts = make(map[*TaskRun]*taskState)
 	}
-	if len(jb.Order) == 0 {
-		jb.OrderProvided = false
-		jb.Order = make([][]string, 0, len(jb.Tasks))
-		for _, t := range jb.Tasks {
-			jb.Order = append(jb.Order, []string{t.Name})
+	for t, part := range parts {
+		run.state.parts[t] = part
+	}
+}
+
+// saveRun writes the run from its snapshots, and removes the oldest runs of the job
+// when it's saved for the first time. Only the leader saves runs.
+func saveRun(run *JobRun) {
+	if !isLeader() {
+		return
+	}
+	st := run.state
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	data, err := st.build()
+	if err != nil {
+		errorLog.Printf("Failed to serialize run %d of '%s': %v", run.Idx, st.title, err)
+		return
+	}
+	dir := filepath.Join(jobStateDir(st.title), "runs")
+	if err := writeFileAtomic(filepath.Join(dir, st.file), data); err != nil {
+		errorLog.Printf("Failed to save run %d of '%s': %v", run.Idx, st.title, err)
+		return
+	}
+	if st.saved {
+		return
+	}
+	st.saved = true
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	// names sort by start time
+	for len(files) > maxSavedRuns {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+}
+
+// build joins the snapshots of the run and its tasks, it expects mu to be held.
+func (st *runState) build() ([]byte, error) {
+	var run map[string]json.RawMessage
+	if err := json.Unmarshal(st.run, &run); err != nil {
+		return nil, err
+	}
+	tasks := make([]json.RawMessage, 0, len(st.tasks))
+	for _, tr := range st.tasks {
+		data, err := st.buildTask(tr)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		jb.OrderProvided = true
+		tasks = append(tasks, data)
 	}
-	for _, order := range jb.Order {
-		for _, taskName := range order {
-			if _, ok := jb.taskMap[taskName]; !ok {
-				errorLog.Printf("%s: Task '%s' in Order is not defined. Skipping job altogether.\n", filePath, taskName)
-				webLog.Printf("%s: Task '%s' in Order is not defined. Skipping job altogether. \n", filePath, taskName)
-				return nil, errors.New("Task in Order is not defined")
-			}
+	var err error
+	if run["TasksHistory"], err = json.Marshal(tasks); err != nil {
+		return nil, err
+	}
+	return json.Marshal(run)
+}
+
+func (st *runState) buildTask(tr *TaskRun) (json.RawMessage, error) {
+	part := st.parts[tr]
+	if part == nil {
+		return nil, fmt.Errorf("task '%s' not serialized", tr.Name)
+	}
+	if len(part.items) == 0 {
+		return part.data, nil
+	}
+	var task map[string]json.RawMessage
+	if err := json.Unmarshal(part.data, &task); err != nil {
+		return nil, err
+	}
+	items := make([]json.RawMessage, 0, len(part.items))
+	for _, item := range part.items {
+		if data, err := st.buildTask(item); err == nil {
+			items = append(items, data)
 		}
 	}
-	_, err = JC.parser.Parse(jb.Cron)
-	if jb.Cron != "" && err != nil {
-		errorLog.Printf("%s: can't parse cron \"%s\". %v.\n", filePath, jb.Cron, err)
-		webLog.Printf("%s: can't parse cron \"%s\". %v.\n", filePath, jb.Cron, err)
+	var err error
+	if task["Items"], err = json.Marshal(items); err != nil {
 		return nil, err
 	}
-	exprDesc, _ := hcron.NewDescriptor(hcron.Use24HourTimeFormat(true))
-	jb.HCron, err = exprDesc.ToDescription(jb.Cron, hcron.Locale_en)
-	if jb.Cron == "" {
-		jb.HCron = ""
-	} else if err != nil {
-		jb.HCron = jb.Cron
+	return json.Marshal(task)
+}
+
+// writeFileAtomic replaces the file so readers never see it half written.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
 	}
-	return &jb, nil
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
 
-func scheduleJob(jb *Job) {
-	var err error
-	jb.Id = JC.jobCounter
-	JC.Jobs[JC.jobCounter] = jb
-	JC.jobCounter += 1
-	if jb.Cron != "" {
-		jb.cronID, err = JC.cron.AddFunc(
-			jb.Cron,
-			func() { runScheduled(jb, JC.cron) },
-		)
+// loadJobState replaces the on/off state and the runs of the job with the saved ones.
+// Saved tasks that are no longer in the job are dropped.
+func loadJobState(jb *Job) {
+	dir := jobStateDir(jb.Title)
+	data, err := os.ReadFile(filepath.Join(dir, "job.json"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		errorLog.Printf("Failed to read state of '%s': %v", jb.Title, err)
+		return
+	}
+	if err == nil {
+		var state jobState
+		if err := json.Unmarshal(data, &state); err != nil {
+			errorLog.Printf("Failed to parse state of '%s': %v", jb.Title, err)
+			return
+		}
+		jb.OnOff = state.OnOff
+	}
+	jb.stateModTime = stateModTime(jb)
+	files, _ := filepath.Glob(filepath.Join(dir, "runs", "*.json"))
+	if len(files) > maxSavedRuns {
+		files = files[len(files)-maxSavedRuns:]
+	}
+	if len(files) == 0 && errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	jb.RunHistory = make([]*JobRun, 0, len(files))
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err == nil {
+			err = restoreRun(jb, filepath.Base(f), data)
+		}
 		if err != nil {
-			errorLog.Printf("Error scheduling job '%s' from file '%s': %v\n", jb.Title, jb.file, err)
-			webLog.Printf("Error scheduling job '%s' from file '%s': %v\n", jb.Title, jb.file, err)
+			errorLog.Printf("Failed to restore run %s of '%s': %v", filepath.Base(f), jb.Title, err)
 		}
-		infoLog.Printf("Added job '%s' from file '%s'", jb.Title, jb.file)
 	}
 }
 
-func runScheduled(jb *Job, c *cron.Cron) {
-	//todo: check race conditions
-	if !jb.OnOff {
-		infoLog.Printf("Skipping '%s'", jb.Title)
-		return
+// stateModTime returns the time the saved state of the job last changed.
+// Files are replaced on save, so the modification times of the directories change.
+func stateModTime(jb *Job) time.Time {
+	var latest time.Time
+	dir := jobStateDir(jb.Title)
+	for _, d := range []string{dir, filepath.Join(dir, "runs")} {
+		if info, err := os.Stat(d); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
 	}
-	run := initRun(jb, c)
-	go runJob(run, jb)
-	jb.NextScheduled = c.Entry(jb.cronID).Next
-	//todo: check for errors
+	return latest
+}
+
+// resumeRuns continues the saved runs that were active when the previous leader or process stopped.
+func resumeRuns() {
+	for _, jb := range loadedJobs() {
+		for _, run := range jb.RunHistory {
+			// runs of job tasks are resumed by their tasks
+			if run.Status != Running || run.ctxCancelFn != nil || run.depth > 0 {
+				continue
+			}
+			infoLog.Printf("Resuming run %d of '%s'", run.Idx, jb.Title)
+			run.resumed = true
+			go runJob(run, jb)
+		}
+	}
+}
+
+// resumeTask continues a task of a resumed run. Finished tasks keep their status,
+// a task whose process survived is adopted, a job task waits for the run it started,
+// other active tasks are interrupted and retried if they have retries left.
+func resumeTask(ctx context.Context, tr *TaskRun) error {
+	switch {
+	case tr.Status == RunFailure || tr.Status == Interrupted:
+		return errors.New("failed before the restart")
+	case !isActive(tr.Status):
+		return nil
+	case tr.Status == WaitingRetry:
+		if err := waitRetry(ctx, tr, time.Until(tr.NextAttempt)); err != nil {
+			return err
+		}
+		return runTaskWithRetries(ctx, tr)
+	case tr.Process != nil && tr.Process.alive() || subJobRun(tr) != nil:
+		var err error
+		if run := subJobRun(tr); run != nil {
+			err = resumeSubJob(ctx, tr, run)
+		} else {
+			err = adoptTask(ctx, tr)
+		}
+		retry, reason := retryDecision(tr, err, tr.Attempt)
+		recordAttempt(tr, retry, reason)
+		if !retry {
+			markAllowedFailure(tr, err)
+			return err
+		}
+	default:
+		infoLog.Printf("Task '%s'-'%s' was interrupted", tr.jobTitle, tr.Name)
+		if tr.Process != nil {
+			tr.Process.remove()
+			for _, f := range tr.Process.TempFiles {
+				os.Remove(f)
+			}
+			tr.Process = nil
+		}
+		tr.Status = Interrupted
+		tr.FailureReason = "interrupted by a restart"
+		tr.EndTime = time.Now()
+		retry := tr.Attempt <= tr.retries
+		recordAttempt(tr, retry, "interrupted")
+		generateEvent("task_finished", nil, tr)
+		if !retry {
+			return errors.New(tr.FailureReason)
+		}
+	}
+	if delay := retryDelay(tr, tr.Attempt); delay > 0 {
+		if err := waitRetry(ctx, tr, delay); err != nil {
+			return err
+		}
+	}
+	return runTaskWithRetries(ctx, tr)
 }
 
-func initRun(jb *Job, c *cron.Cron) *JobRun {
-	var scheduled_time time.Time
-	if c != nil {
-		scheduled_time = c.Entry(jb.cronID).Prev
+// adoptTask waits for the process of a task that survived a restart and records its result.
+func adoptTask(ctx context.Context, tr *TaskRun) error {
+	p := tr.Process
+	infoLog.Printf("Adopting task '%s'-'%s', pid %d", tr.jobTitle, tr.Name, p.Pid)
+	// renders the command again to collect the secrets to redact
+	renderCmdTemplate(tr, tr.cmd)
+	renderCmdTemplate(tr, tr.script)
+	for _, arg := range tr.args {
+		renderCmdTemplate(tr, arg)
+	}
+	execCtx, cancel := context.WithCancel(ctx)
+	if tr.timeout > 0 {
+		execCtx, cancel = context.WithDeadline(ctx, tr.StartTime.Add(time.Duration(tr.timeout)*time.Second))
+	}
+	tr.ctxCancelFn = cancel
+	defer func() {
+		if tr.ctxCancelFn != nil {
+			tr.ctxCancelFn()
+			tr.ctxCancelFn = nil
+		}
+	}()
+	generateEvent("task_running", nil, tr)
+	stop, done := make(chan struct{}), make(chan struct{})
+	if logFile := openTaskLog(tr); logFile != nil {
+		go func() {
+			followFile(p.Output, logFile, stop)
+			logFile.Close()
+			close(done)
+		}()
 	} else {
-		scheduled_time = time.Now()
+		close(done)
 	}
-	run := &JobRun{
-		Idx:           len(jb.RunHistory),
-		jobId:         jb.Id,
-		ScheduledTime: scheduled_time,
-		StartTime:     time.Now(),
+	err := p.wait(execCtx)
+	close(stop)
+	<-done
+	output, _ := os.ReadFile(p.Output)
+	defer func() {
+		p.remove()
+		for _, f := range p.TempFiles {
+			os.Remove(f)
+		}
+	}()
+	tr.Process = nil
+	var outputFile string
+	if len(p.TempFiles) > 0 {
+		outputFile = p.TempFiles[0]
 	}
-	idx := 0
-	for _, taskGr := range jb.Order {
-		for _, taskName := range taskGr {
-			t, _ := jb.taskMap[taskName]
-			emails := t.Emails
-			if len(emails) == 0 {
-				emails = jb.Emails
+	return finishTask(execCtx, tr, string(output), outputFile, err)
+}
+
+func restoreRun(jb *Job, file string, data []byte) error {
+	var saved struct {
+		ScheduledTime time.Time
+		Params        map[string]interface{}
+		Depth         int
+		TasksHistory  []json.RawMessage
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	run := initRun(jb, saved.ScheduledTime, saved.Params)
+	run.depth = saved.Depth
+	tasks := run.TasksHistory
+	run.TasksHistory = nil
+	if err := json.Unmarshal(data, run); err != nil {
+		return err
+	}
+	run.Idx = len(jb.RunHistory) - 1
+	run.TasksHistory = tasks
+	for _, data := range saved.TasksHistory {
+		var name struct{ Name string }
+		if err := json.Unmarshal(data, &name); err != nil {
+			return err
+		}
+		for _, tr := range tasks {
+			if tr.Name != name.Name {
+				continue
 			}
-			retries := t.Retries
-			if retries == 0 {
-				retries = jb.Retries
+			if err := json.Unmarshal(data, tr); err != nil {
+				return err
 			}
-			timeout := t.TimeoutSec
-			if timeout == 0 {
-				timeout = jb.TaskTimeoutSec
+			for _, item := range tr.Items {
+				item.jobTitle = tr.jobTitle
+				item.jobRun = run
+			}
+		}
+	}
+	run.state.file = file
+	run.state.saved = true
+	snapshotRun(run)
+	return nil
+}
+
+// reloadJobStates loads the states saved by the leader when they change.
+func reloadJobStates() {
+	changed := false
+	for _, jb := range loadedJobs() {
+		if !stateModTime(jb).After(jb.stateModTime) {
+			continue
+		}
+		loadJobState(jb)
+		changed = true
+	}
+	if changed {
+		generateEvent("jobs_updated", nil, nil)
+	}
+}
+
+// LEADER is the state of the leader election in HA mode.
+var LEADER struct {
+	mu       sync.Mutex
+	leader   bool
+	holder   string
+	released bool
+}
+
+type lease struct {
+	Holder  string
+	Expires time.Time
+}
+
+func isLeader() bool {
+	if !CONF.ha {
+		return true
+	}
+	LEADER.mu.Lock()
+	defer LEADER.mu.Unlock()
+	return LEADER.leader
+}
+
+func leaderId() string {
+	LEADER.mu.Lock()
+	defer LEADER.mu.Unlock()
+	return LEADER.holder
+}
+
+// electLeader renews the lease of the leader or waits for it to expire.
+// The leader starts the scheduler, followers reload the states saved by the leader.
+func electLeader() {
+	var renewed time.Time
+	for {
+		holder, takeover, err := acquireLease()
+		if err != nil {
+			errorLog.Printf("Failed to acquire the leader lease: %v", err)
+			// the leader keeps its runs until the lease it holds expires
+			if isLeader() && time.Since(renewed) < CONF.leaseDuration {
+				time.Sleep(CONF.leaseDuration / 3)
+				continue
+			}
+		} else if holder == CONF.instanceId {
+			renewed = time.Now()
+		}
+		setLeader(err == nil && holder == CONF.instanceId, holder, takeover)
+		if !isLeader() {
+			reloadJobStates()
+		}
+		time.Sleep(CONF.leaseDuration / 3)
+	}
+}
+
+// acquireLease takes the lease when it's free, expired or held by this instance, and returns its holder.
+// takeover is true when the instance took the expired lease of another one.
+// Instances sharing the state directory serialize on the lock file.
+func acquireLease() (holder string, takeover bool, err error) {
+	if err := os.MkdirAll(CONF.stateDir, 0755); err != nil {
+		return "", false, err
+	}
+	lock, err := os.OpenFile(filepath.Join(CONF.stateDir, "leader.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return "", false, err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return "", false, err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	path := filepath.Join(CONF.stateDir, "leader.json")
+	var l lease
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &l); err != nil {
+			return "", false, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", false, err
+	}
+	LEADER.mu.Lock()
+	released := LEADER.released
+	LEADER.mu.Unlock()
+	if released || l.Holder != "" && l.Holder != CONF.instanceId && time.Now().Before(l.Expires) {
+		return l.Holder, false, nil
+	}
+	takeover = l.Holder != "" && l.Holder != CONF.instanceId
+	l = lease{Holder: CONF.instanceId, Expires: time.Now().Add(CONF.leaseDuration)}
+	if data, err = json.Marshal(l); err != nil {
+		return "", false, err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return "", false, err
+	}
+	return l.Holder, takeover, nil
+}
+
+// releaseLease expires the lease held by this instance so that a follower takes over without waiting.
+// The instance doesn't take the lease again.
+func releaseLease() error {
+	LEADER.mu.Lock()
+	LEADER.released = true
+	LEADER.mu.Unlock()
+	lock, err := os.OpenFile(filepath.Join(CONF.stateDir, "leader.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	path := filepath.Join(CONF.stateDir, "leader.json")
+	var l lease
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &l); err != nil {
+		return err
+	}
+	if l.Holder != CONF.instanceId {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// setLeader starts the scheduler when the instance becomes the leader and stops it when it steps down.
+// A leader that steps down cancels its runs, the new leader resumes them.
+// Runs of a leader whose lease expired are resumed after twice the lease duration,
+// so that a leader that was paused meanwhile steps down and kills its tasks first.
+func setLeader(leader bool, holder string, takeover bool) {
+	LEADER.mu.Lock()
+	was := LEADER.leader
+	LEADER.leader = leader
+	LEADER.holder = holder
+	LEADER.mu.Unlock()
+	JC.Leader = holder
+	if leader && !was {
+		infoLog.Printf("Became the leader")
+		loadProcessedTriggerFiles()
+		loadWebhookKeys()
+		for _, jb := range loadedJobs() {
+			loadJobState(jb)
+			if jb.OnOff {
+				jb.NextScheduled = nextScheduled(jb)
+				scanWatchedFiles(jb)
+			}
+		}
+		JC.Follower = false
+		if takeover {
+			infoLog.Printf("Took over an expired lease, resuming runs in %v", 2*CONF.leaseDuration)
+			time.AfterFunc(2*CONF.leaseDuration, func() {
+				if isLeader() {
+					resumeRuns()
+				}
+			})
+		} else {
+			resumeRuns()
+		}
+		JC.cron.Start()
+		generateEvent("jobs_updated", nil, nil)
+	} else if !leader && was {
+		infoLog.Printf("Stepped down, the leader is '%s'", holder)
+		JC.cron.Stop()
+		// on shutdown the lease is released after the runs are handled
+		if !ACTIVERUNS.isStopping() {
+			if runs := ACTIVERUNS.interrupt(); len(runs) > 0 {
+				infoLog.Printf("Cancelled %d active runs, the leader resumes them", len(runs))
+			}
+		}
+		JC.Follower = true
+		for _, jb := range loadedJobs() {
+			jb.NextScheduled = time.Time{}
+		}
+		generateEvent("jobs_updated", nil, nil)
+	}
+}
+
+// loadedJobs returns the jobs so that they can be iterated while the map changes.
+func loadedJobs() []*Job {
+	JC.mu.RLock()
+	defer JC.mu.RUnlock()
+	jobs := make([]*Job, 0, len(JC.Jobs))
+	for _, jb := range JC.Jobs {
+		jobs = append(jobs, jb)
+	}
+	return jobs
+}
+
+func jobById(id int) *Job {
+	JC.mu.RLock()
+	defer JC.mu.RUnlock()
+	return JC.Jobs[id]
+}
+
+func findJobByTitle(title string) *Job {
+	JC.mu.RLock()
+	defer JC.mu.RUnlock()
+	return jobByTitle(title)
+}
+
+// jobByTitle expects JC.mu to be held.
+func jobByTitle(title string) *Job {
+	for _, jb := range JC.Jobs {
+		if jb.Title == title {
+			return jb
+		}
+	}
+	return nil
+}
+
+func scanAndScheduleJobs() {
+	files := make(map[string][16]byte)
+	err := scanFiles(files)
+	webLogBuf.Reset()
+	if err != nil {
+		errorLog.Printf("Errors while reading files: %s", err)
+		webLog.Printf("Errors while reading files: %s", err)
+	}
+	removeJobsWithoutFiles(files)
+	for f := range files {
+		infoLog.Printf("Loading %s", f)
+		jobs, err := processJobFile(f)
+		if len(jobs) != 0 && err == nil {
+			for _, jb := range jobs {
+				scheduleJob(jb)
+			}
+		} else {
+			infoLog.Printf("Skipping %s", f)
+		}
+	}
+	updateTriggerWatches()
+	generateEvent("jobs_updated", nil, nil)
+}
+
+func scanFiles(files map[string][16]byte) error {
+	err := filepath.Walk(CONF.jobsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			errorLog.Printf("Error accessing path %s: %v\n", path, err)
+			return err
+		}
+		if !info.IsDir() && filepath.Ext(path) == ".job" {
+			// errors in base files are reported by processJobFile
+			_, _, jobFiles, _ := loadJobConfig(path)
+			if len(jobFiles) == 0 {
+				jobFiles = []string{path}
+			}
+			sum, err := hashFiles(jobFiles)
+			if err != nil {
+				errorLog.Printf("Error reading file %s: %v\n", path, err)
+				return err
+			}
+			files[path] = sum
+		}
+		return nil
+	})
+	return err
+}
+
+func removeJobsWithoutFiles(files map[string][16]byte) {
+	var toremove []int
+	unchanged := make(map[string]bool)
+	for id, jb := range JC.Jobs {
+		md5, haskey := files[jb.file]
+		if !haskey {
+			infoLog.Printf("Marking %s for deletion", jb.Title)
+			toremove = append(toremove, id)
+		} else if md5 != jb.md5 {
+			infoLog.Printf("File %s has changed, marking for reloading", jb.file)
+			toremove = append(toremove, id)
+		} else if md5 == jb.md5 {
+			infoLog.Printf("File %s has not changed, skipping", jb.file)
+			unchanged[jb.file] = true
+		} else {
+			panic("This is not supposed to happen")
+		}
+	}
+	// a file can define several jobs
+	for f := range unchanged {
+		delete(files, f)
+	}
+	for _, id := range toremove {
+		jb := JC.Jobs[id]
+		JC.mu.Lock()
+		delete(JC.Jobs, id)
+		JC.mu.Unlock()
+		JC.cron.Remove(jb.cronID)
+		cancelActiveJobRuns(jb)
+	}
+}
+
+// hashFiles returns the md5 of the concatenated contents of files.
+func hashFiles(files []string) ([16]byte, error) {
+	var sum [16]byte
+	h := md5.New()
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return sum, err
+		}
+		h.Write(data)
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// configLayer is a config file read for a job, with its text and its values.
+type configLayer struct {
+	file   string
+	data   string
+	config map[string]interface{}
+}
+
+// loadJobConfig reads a job file and merges it over the files it extends.
+// It returns the merged config, the files as layers in the order of precedence, lowest first,
+// and the files read, the job file first.
+func loadJobConfig(filePath string) (map[string]interface{}, []configLayer, []string, error) {
+	layers, files, err := loadConfigFile(filePath, nil)
+	if err != nil {
+		return nil, nil, files, err
+	}
+	config := make(map[string]interface{})
+	for _, l := range layers {
+		mergeConfig(config, l.config)
+	}
+	return config, layers, files, nil
+}
+
+// loadConfigFile reads a config file and the files listed in its extends key.
+// Values of the file take precedence over its bases, and later bases take
+// precedence over earlier ones. Tables are merged key by key,
+// other values, including arrays such as tasks, replace the base value as a whole.
+// Relative paths in extends are resolved against the directory of the file.
+func loadConfigFile(filePath string, chain []string) ([]configLayer, []string, error) {
+	if containsString(chain, filePath) {
+		return nil, nil, fmt.Errorf("extends cycle: %s -> %s", strings.Join(chain, " -> "), filePath)
+	}
+	chain = append(chain, filePath)
+	files := []string{filePath}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, files, err
+	}
+	config := make(map[string]interface{})
+	if _, err := toml.Decode(string(data), &config); err != nil {
+		return nil, files, fmt.Errorf("%s: %v", filePath, err)
+	}
+	var bases []string
+	switch extends := config["extends"].(type) {
+	case nil:
+	case string:
+		bases = []string{extends}
+	case []interface{}:
+		for _, b := range extends {
+			base, ok := b.(string)
+			if !ok {
+				return nil, files, fmt.Errorf("%s: extends must be a file name or a list of file names", filePath)
+			}
+			bases = append(bases, base)
+		}
+	default:
+		return nil, files, fmt.Errorf("%s: extends must be a file name or a list of file names", filePath)
+	}
+	delete(config, "extends")
+	var layers []configLayer
+	for _, base := range bases {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(filePath), base)
+		}
+		baseLayers, baseFiles, err := loadConfigFile(base, chain)
+		files = append(files, baseFiles...)
+		if err != nil {
+			return nil, files, err
+		}
+		layers = append(layers, baseLayers...)
+	}
+	layers = append(layers, configLayer{file: filePath, data: string(data), config: config})
+	return layers, files, nil
+}
+
+// clearArrays resets the fields of jb that config sets to arrays,
+// since arrays replace the base value as a whole while decoding merges them.
+func clearArrays(jb *Job, config map[string]interface{}) {
+	v := reflect.ValueOf(jb).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("toml"), ",")
+		if value, ok := config[key]; ok && reflect.ValueOf(value).Kind() == reflect.Slice {
+			v.Field(i).Set(reflect.Zero(v.Field(i).Type()))
+		}
+	}
+}
+
+// mergeConfig merges src into dst, src values take precedence.
+func mergeConfig(dst map[string]interface{}, src map[string]interface{}) {
+	for k, v := range src {
+		srcTable, ok := v.(map[string]interface{})
+		dstTable, dstOk := dst[k].(map[string]interface{})
+		if ok && dstOk {
+			merged := make(map[string]interface{})
+			mergeConfig(merged, dstTable)
+			mergeConfig(merged, srcTable)
+			dst[k] = merged
+		} else {
+			dst[k] = v
+		}
+	}
+}
+
+// processJobFile returns the jobs defined by a file.
+// A file with a [matrix] table defines a job for each combination of matrix values,
+// otherwise a single job.
+func processJobFile(filePath string) ([]*Job, error) {
+	config, layers, files, err := loadJobConfig(filePath)
+	if err != nil {
+		errorLog.Printf("Error reading file %s: %v\n", filePath, err)
+		webLog.Printf("Error reading file %s: %v\n", filePath, err)
+		return nil, err
+	}
+	md5, err := hashFiles(files)
+	if err != nil {
+		errorLog.Printf("Error reading file %s: %v\n", filePath, err)
+		webLog.Printf("Error reading file %s: %v\n", filePath, err)
+		return nil, err
+	}
+	combinations, err := matrixCombinations(config["matrix"])
+	if err != nil {
+		errorLog.Printf("%s: %v. Skipping.\n", filePath, err)
+		webLog.Printf("%s: %v. Skipping.\n", filePath, err)
+		return nil, err
+	}
+	var jobs []*Job
+	titles := make(map[string]bool)
+	for _, matrix := range combinations {
+		jb, err := processJobConfig(filePath, layers, matrix)
+		if jb == nil || err != nil {
+			return nil, err
+		}
+		if titles[jb.Title] {
+			errorLog.Printf("%s: duplicate job title '%s', use matrix values in the title. Skipping.\n", filePath, jb.Title)
+			webLog.Printf("%s: duplicate job title '%s', use matrix values in the title. Skipping.\n", filePath, jb.Title)
+			return nil, fmt.Errorf("duplicate job title '%s'", jb.Title)
+		}
+		titles[jb.Title] = true
+		jb.md5 = md5
+		jb.baseFiles = files[1:]
+		jb.config = config
+		jobs = append(jobs, jb)
+	}
+	return jobs, nil
+}
+
+// matrixCombinations returns the cartesian product of matrix values,
+// or a single nil combination if there is no matrix.
+func matrixCombinations(matrix interface{}) ([]map[string]interface{}, error) {
+	if matrix == nil {
+		return []map[string]interface{}{nil}, nil
+	}
+	table, ok := matrix.(map[string]interface{})
+	if !ok || len(table) == 0 {
+		return nil, errors.New("matrix must be a table of value lists")
+	}
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	combinations := []map[string]interface{}{{}}
+	for _, k := range keys {
+		values, ok := table[k].([]interface{})
+		if !ok || len(values) == 0 {
+			return nil, fmt.Errorf("matrix '%s' must be a non-empty list of values", k)
+		}
+		var next []map[string]interface{}
+		for _, c := range combinations {
+			for _, v := range values {
+				combination := make(map[string]interface{}, len(c)+1)
+				for ck, cv := range c {
+					combination[ck] = cv
+				}
+				combination[k] = v
+				next = append(next, combination)
+			}
+		}
+		combinations = next
+	}
+	return combinations, nil
+}
+
+// renderMatrixTemplate renders matrix values into job title, cron and sub-job names.
+func renderMatrixTemplate(text string, matrix map[string]interface{}) (string, error) {
+	tmpl, err := texttemplate.New("tmpl").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	sb := new(strings.Builder)
+	err = tmpl.Execute(sb, map[string]interface{}{"matrix": matrix})
+	return sb.String(), err
+}
+
+func processJobConfig(filePath string, layers []configLayer, matrix map[string]interface{}) (*Job, error) {
+	var jb Job
+	jb.file = filePath
+	jb.OnOff = false
+	jb.RunHistory = make([]*JobRun, 0)
+	var err error
+	// each file is decoded over its bases, so that errors point at the lines of the file
+	for _, l := range layers {
+		clearArrays(&jb, l.config)
+		if _, err = toml.Decode(l.data, &jb); err != nil {
+			errorLog.Printf("Error parsing file %s: %v\n", l.file, err)
+			webLog.Printf("Error parsing file %s: %v\n", l.file, err)
+			return nil, err
+		}
+	}
+	if matrix != nil {
+		jb.Matrix = matrix
+		jb.Title, err = renderMatrixTemplate(jb.Title, matrix)
+		if err == nil {
+			jb.Cron, err = renderMatrixTemplate(jb.Cron, matrix)
+		}
+		for _, t := range jb.Tasks {
+			if err == nil {
+				t.Job, err = renderMatrixTemplate(t.Job, matrix)
+			}
+		}
+		if err != nil {
+			errorLog.Printf("%s: error rendering matrix values: %v. Skipping.\n", filePath, err)
+			webLog.Printf("%s: error rendering matrix values: %v. Skipping.\n", filePath, err)
+			return nil, err
+		}
+	}
+	if jb.Title == "" {
+		errorLog.Printf("%s: missing job title. Skipping.\n", filePath)
+		webLog.Printf("%s: missing job title. Skipping. \n", filePath)
+		return nil, nil
+	}
+	if len(jb.Tasks) == 0 {
+		errorLog.Printf("%s: no tasks. Skipping.\n", filePath)
+		webLog.Printf("%s: no tasks. Skipping. \n", filePath)
+		return nil, nil
+	}
+	taskNames := make(map[string]bool)
+	for _, t := range jb.Tasks {
+		if len(t.Name) == 0 || len(t.Cmd) == 0 && len(t.Args) == 0 && t.Script == "" && !isSensorTask(t) && t.Job == "" {
+			errorLog.Printf("%s: Task name or cmd is empty. Skipping job altogether.\n", filePath)
+			webLog.Printf("%s: Task name or cmd is empty. Skipping job altogether. \n", filePath)
+			return nil, nil
+		}
+		if t.TriggerRule != "" && !containsString(triggerRules, t.TriggerRule) {
+			errorLog.Printf("%s: Task '%s': unknown trigger_rule '%s'. Skipping job altogether.\n", filePath, t.Name, t.TriggerRule)
+			webLog.Printf("%s: Task '%s': unknown trigger_rule '%s'. Skipping job altogether.\n", filePath, t.Name, t.TriggerRule)
+			return nil, fmt.Errorf("unknown trigger_rule '%s'", t.TriggerRule)
+		}
+		if t.Foreach != nil && t.ForeachCmd != "" || (t.Foreach != nil || t.ForeachCmd != "") && t.Cmd == "" && len(t.Args) == 0 && t.Script == "" {
+			errorLog.Printf("%s: Task '%s': foreach and foreach_cmd require cmd, args or script and can't be used together. Skipping job altogether.\n", filePath, t.Name)
+			webLog.Printf("%s: Task '%s': foreach and foreach_cmd require cmd, args or script and can't be used together. Skipping job altogether.\n", filePath, t.Name)
+			return nil, errors.New("bad foreach")
+		}
+		if t.retryOn, err = newRetryConditions(t); err != nil {
+			errorLog.Printf("%s: Task '%s': %v. Skipping job altogether.\n", filePath, t.Name, err)
+			webLog.Printf("%s: Task '%s': %v. Skipping job altogether.\n", filePath, t.Name, err)
+			return nil, err
+		}
+		if err := validateRemote(&jb, t); err != nil {
+			errorLog.Printf("%s: Task '%s': %v. Skipping job altogether.\n", filePath, t.Name, err)
+			webLog.Printf("%s: Task '%s': %v. Skipping job altogether.\n", filePath, t.Name, err)
+			return nil, err
+		}
+		if err := validateSensor(t); err != nil {
+			errorLog.Printf("%s: Task '%s': %v. Skipping job altogether.\n", filePath, t.Name, err)
+			webLog.Printf("%s: Task '%s': %v. Skipping job altogether.\n", filePath, t.Name, err)
+			return nil, err
+		}
+		if taskNames[t.Name] {
+			errorLog.Printf("%s: Duplicate task name '%s'. Skipping job altogether.\n", filePath, t.Name)
+			webLog.Printf("%s: Duplicate task name '%s'. Skipping job altogether.\n", filePath, t.Name)
+			return nil, fmt.Errorf("duplicate task name '%s'", t.Name)
+		} else {
+			taskNames[t.Name] = true
+		}
+	}
+	if jb.Retries < 0 {
+		errorLog.Printf("Job '%s' has negative retries (%d), setting to 0", jb.Title, jb.Retries)
+		webLog.Printf("Job '%s' has negative retries (%d), setting to 0", jb.Title, jb.Retries)
+		jb.Retries = 0
+	}
+	for _, t := range jb.Tasks {
+		if t.Retries < 0 {
+			errorLog.Printf("Task '%s' in job '%s' has negative retries (%d), setting to 0", t.Name, jb.Title, t.Retries)
+			webLog.Printf("Task '%s' in job '%s' has negative retries (%d), setting to 0", t.Name, jb.Title, t.Retries)
+			t.Retries = 0
+		}
+	}
+	if jb.RetryDelaySec < 0 || jb.MaxRetryDelaySec < 0 || jb.RetryBackoff < 0 {
+		errorLog.Printf("Job '%s' has negative retry_delay, max_retry_delay or retry_backoff, setting to 0", jb.Title)
+		webLog.Printf("Job '%s' has negative retry_delay, max_retry_delay or retry_backoff, setting to 0", jb.Title)
+		jb.RetryDelaySec, jb.MaxRetryDelaySec, jb.RetryBackoff = 0, 0, 0
+	}
+	for _, t := range jb.Tasks {
+		if t.RetryDelaySec < 0 || t.MaxRetryDelaySec < 0 || t.RetryBackoff < 0 {
+			errorLog.Printf("Task '%s' in job '%s' has negative retry_delay, max_retry_delay or retry_backoff, setting to 0", t.Name, jb.Title)
+			webLog.Printf("Task '%s' in job '%s' has negative retry_delay, max_retry_delay or retry_backoff, setting to 0", t.Name, jb.Title)
+			t.RetryDelaySec, t.MaxRetryDelaySec, t.RetryBackoff = 0, 0, 0
+		}
+	}
+	if jb.TaskTimeoutSec < 0 {
+		errorLog.Printf("Job '%s' has negative task_timeout (%d), setting to 0", jb.Title, jb.TaskTimeoutSec)
+		webLog.Printf("Job '%s' has negative task_timeout (%d), setting to 0", jb.Title, jb.TaskTimeoutSec)
+		jb.TaskTimeoutSec = 0
+	}
+	if err := validateLimits(jb.Limits); err != nil {
+		errorLog.Printf("%s: %v. Skipping job altogether.\n", filePath, err)
+		webLog.Printf("%s: %v. Skipping job altogether.\n", filePath, err)
+		return nil, err
+	}
+	for _, t := range jb.Tasks {
+		if err := validateLimits(t.Limits); err != nil {
+			errorLog.Printf("%s: Task '%s': %v. Skipping job altogether.\n", filePath, t.Name, err)
+			webLog.Printf("%s: Task '%s': %v. Skipping job altogether.\n", filePath, t.Name, err)
+			return nil, err
+		}
+	}
+	for _, t := range jb.Tasks {
+		if t.MaxParallel < 0 {
+			errorLog.Printf("Task '%s' in job '%s' has negative max_parallel (%d), setting to 0", t.Name, jb.Title, t.MaxParallel)
+			webLog.Printf("Task '%s' in job '%s' has negative max_parallel (%d), setting to 0", t.Name, jb.Title, t.MaxParallel)
+			t.MaxParallel = 0
+		}
+		if t.TimeoutSec < 0 {
+			errorLog.Printf("Task '%s' in job '%s' has negative timeout (%d), setting to 0", t.Name, jb.Title, t.TimeoutSec)
+			webLog.Printf("Task '%s' in job '%s' has negative timeout (%d), setting to 0", t.Name, jb.Title, t.TimeoutSec)
+			t.TimeoutSec = 0
+		}
+	}
+	jb.taskMap = make(map[string]*Task)
+	for _, t := range jb.Tasks {
+		jb.taskMap[t.Name] = t
+	}
+	if len(jb.Order) == 0 {
+		jb.OrderProvided = false
+		jb.Order = make([][]string, 0, len(jb.Tasks))
+		for _, t := range jb.Tasks {
+			jb.Order = append(jb.Order, []string{t.Name})
+		}
+	} else {
+		jb.OrderProvided = true
+	}
+	for _, order := range jb.Order {
+		for _, taskName := range order {
+			if _, ok := jb.taskMap[taskName]; !ok {
+				errorLog.Printf("%s: Task '%s' in Order is not defined. Skipping job altogether.\n", filePath, taskName)
+				webLog.Printf("%s: Task '%s' in Order is not defined. Skipping job altogether. \n", filePath, taskName)
+				return nil, errors.New("Task in Order is not defined")
+			}
+		}
+	}
+	err = buildTaskDeps(&jb)
+	if err == nil {
+		err = validateBranches(&jb)
+	}
+	if err != nil {
+		errorLog.Printf("%s: %v. Skipping job altogether.\n", filePath, err)
+		webLog.Printf("%s: %v. Skipping job altogether. \n", filePath, err)
+		return nil, err
+	}
+	if jb.WatchMinAgeSec < 0 {
+		errorLog.Printf("Job '%s' has negative watch_min_age (%d), setting to 0", jb.Title, jb.WatchMinAgeSec)
+		webLog.Printf("Job '%s' has negative watch_min_age (%d), setting to 0", jb.Title, jb.WatchMinAgeSec)
+		jb.WatchMinAgeSec = 0
+	}
+	for i, pattern := range jb.Watch {
+		pattern = filepath.Clean(pattern)
+		jb.Watch[i] = pattern
+		_, err = filepath.Match(pattern, "")
+		if err != nil || strings.ContainsAny(filepath.Dir(pattern), "*?[") {
+			errorLog.Printf("%s: bad watch pattern \"%s\". Only file names can contain wildcards.\n", filePath, pattern)
+			webLog.Printf("%s: bad watch pattern \"%s\". Only file names can contain wildcards.\n", filePath, pattern)
+			return nil, fmt.Errorf("bad watch pattern \"%s\"", pattern)
+		}
+	}
+	_, err = JC.parser.Parse(jb.Cron)
+	if jb.Cron != "" && err != nil {
+		errorLog.Printf("%s: can't parse cron \"%s\". %v.\n", filePath, jb.Cron, err)
+		webLog.Printf("%s: can't parse cron \"%s\". %v.\n", filePath, jb.Cron, err)
+		return nil, err
+	}
+	exprDesc, _ := hcron.NewDescriptor(hcron.Use24HourTimeFormat(true))
+	jb.HCron, err = exprDesc.ToDescription(jb.Cron, hcron.Locale_en)
+	if jb.Cron == "" {
+		jb.HCron = ""
+	} else if err != nil {
+		jb.HCron = jb.Cron
+	}
+	return &jb, nil
+}
+
+// buildTaskDeps sets dependencies between tasks in the flattened Order.
+// Without depends_on, each task depends on all tasks of the previous Order group.
+// With depends_on and without order, Order is filled with dependency levels
+// and tasks depend only on the declared tasks.
+// With both, tasks depend on the previous Order group and the declared tasks.
+func buildTaskDeps(jb *Job) error {
+	usesDeps := false
+	for _, t := range jb.Tasks {
+		for _, d := range t.DependsOn {
+			if _, ok := jb.taskMap[d]; !ok {
+				return fmt.Errorf("task '%s' depends on undefined task '%s'", t.Name, d)
+			}
+			if d == t.Name {
+				return fmt.Errorf("task '%s' depends on itself", t.Name)
+			}
+			usesDeps = true
+		}
+	}
+	groupDeps := !usesDeps || jb.OrderProvided
+	if usesDeps && !jb.OrderProvided {
+		levels, err := taskLevels(jb)
+		if err != nil {
+			return err
+		}
+		jb.Order = levels
+		jb.OrderProvided = true
+	}
+	position := make(map[string]int)
+	var flat []string
+	for _, group := range jb.Order {
+		for _, taskName := range group {
+			if _, ok := position[taskName]; ok && usesDeps {
+				return fmt.Errorf("task '%s' appears in order more than once, not allowed with depends_on", taskName)
+			}
+			position[taskName] = len(flat)
+			flat = append(flat, taskName)
+		}
+	}
+	jb.taskDeps = make([][]int, 0, len(flat))
+	var prevGroup []int
+	for _, group := range jb.Order {
+		var curGroup []int
+		for _, taskName := range group {
+			var deps []int
+			if groupDeps {
+				deps = append(deps, prevGroup...)
+			}
+			for _, d := range jb.taskMap[taskName].DependsOn {
+				p, ok := position[d]
+				if !ok {
+					return fmt.Errorf("task '%s' depends on '%s' which is not in order", taskName, d)
+				}
+				deps = append(deps, p)
+			}
+			curGroup = append(curGroup, len(jb.taskDeps))
+			jb.taskDeps = append(jb.taskDeps, deps)
+		}
+		prevGroup = curGroup
+	}
+	// detect cycles, e.g. depends_on pointing to a later order group
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(jb.taskDeps))
+	var visit func(i int) error
+	visit = func(i int) error {
+		if state[i] == visiting {
+			return fmt.Errorf("dependency cycle through task '%s'", flat[i])
+		} else if state[i] == visited {
+			return nil
+		}
+		state[i] = visiting
+		for _, d := range jb.taskDeps[i] {
+			if err := visit(d); err != nil {
+				return err
+			}
+		}
+		state[i] = visited
+		return nil
+	}
+	for i := range jb.taskDeps {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateBranches checks that branch targets are downstream of the branching task.
+func validateBranches(jb *Job) error {
+	positions := make(map[string][]int)
+	idx := 0
+	for _, group := range jb.Order {
+		for _, taskName := range group {
+			positions[taskName] = append(positions[taskName], idx)
+			idx += 1
+		}
+	}
+	for _, t := range jb.Tasks {
+		for key, targets := range t.Branches {
+			for _, target := range targets {
+				if _, ok := jb.taskMap[target]; !ok {
+					return fmt.Errorf("branch '%s' of task '%s' refers to undefined task '%s'", key, t.Name, target)
+				}
+				for _, from := range positions[t.Name] {
+					for _, to := range positions[target] {
+						if !isDownstream(jb, to, from) {
+							return fmt.Errorf("branch target '%s' doesn't depend on task '%s'", target, t.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isDownstream reports whether task i in the flattened Order transitively depends on task j.
+func isDownstream(jb *Job, i int, j int) bool {
+	visited := make(map[int]bool)
+	stack := []int{i}
+	for len(stack) > 0 {
+		cur := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, d := range jb.taskDeps[cur] {
+			if d == j {
+				return true
+			} else if !visited[d] {
+				visited[d] = true
+				stack = append(stack, d)
+			}
+		}
+	}
+	return false
+}
+
+// taskLevels groups tasks by the length of the longest dependency chain leading to them.
+func taskLevels(jb *Job) ([][]string, error) {
+	level := make(map[string]int)
+	var visit func(t *Task, path map[string]bool) (int, error)
+	visit = func(t *Task, path map[string]bool) (int, error) {
+		if l, ok := level[t.Name]; ok {
+			return l, nil
+		}
+		if path[t.Name] {
+			return 0, fmt.Errorf("dependency cycle through task '%s'", t.Name)
+		}
+		path[t.Name] = true
+		l := 0
+		for _, d := range t.DependsOn {
+			dl, err := visit(jb.taskMap[d], path)
+			if err != nil {
+				return 0, err
+			}
+			if dl+1 > l {
+				l = dl + 1
+			}
+		}
+		delete(path, t.Name)
+		level[t.Name] = l
+		return l, nil
+	}
+	var levels [][]string
+	for _, t := range jb.Tasks {
+		l, err := visit(t, make(map[string]bool))
+		if err != nil {
+			return nil, err
+		}
+		for len(levels) <= l {
+			levels = append(levels, []string{})
+		}
+	}
+	for _, t := range jb.Tasks {
+		levels[level[t.Name]] = append(levels[level[t.Name]], t.Name)
+	}
+	return levels, nil
+}
+
+func scheduleJob(jb *Job) {
+	var err error
+	// the job is added once its state is loaded
+	JC.mu.Lock()
+	jb.Id = JC.jobCounter
+	JC.jobCounter += 1
+	JC.mu.Unlock()
+	loadJobState(jb)
+	JC.mu.Lock()
+	JC.Jobs[jb.Id] = jb
+	JC.mu.Unlock()
+	if jb.Cron != "" {
+		jb.cronID, err = JC.cron.AddFunc(
+			jb.Cron,
+			func() { runScheduled(jb, JC.cron) },
+		)
+		if err != nil {
+			errorLog.Printf("Error scheduling job '%s' from file '%s': %v\n", jb.Title, jb.file, err)
+			webLog.Printf("Error scheduling job '%s' from file '%s': %v\n", jb.Title, jb.file, err)
+		}
+		infoLog.Printf("Added job '%s' from file '%s'", jb.Title, jb.file)
+	}
+	if jb.OnOff && !JC.Follower {
+		jb.NextScheduled = nextScheduled(jb)
+	}
+}
+
+// nextScheduled returns the next cron time of the job, zero for jobs without cron.
+// Unlike cron entries, it's valid before the scheduler computes them.
+func nextScheduled(jb *Job) time.Time {
+	entry := JC.cron.Entry(jb.cronID)
+	if entry.Schedule == nil {
+		return time.Time{}
+	}
+	return entry.Schedule.Next(time.Now())
+}
+
+func runScheduled(jb *Job, c *cron.Cron) {
+	//todo: check race conditions
+	if !jb.OnOff || !isLeader() {
+		infoLog.Printf("Skipping '%s'", jb.Title)
+		return
+	}
+	run := initRun(jb, c.Entry(jb.cronID).Prev, nil)
+	go runJob(run, jb)
+	jb.NextScheduled = c.Entry(jb.cronID).Next
+	//todo: check for errors
+}
+
+func initRun(jb *Job, scheduled_time time.Time, params map[string]interface{}) *JobRun {
+	run := &JobRun{
+		Idx:           len(jb.RunHistory),
+		jobId:         jb.Id,
+		ScheduledTime: scheduled_time,
+		StartTime:     time.Now(),
+		params:        params,
+	}
+	idx := 0
+	for _, taskGr := range jb.Order {
+		for _, taskName := range taskGr {
+			t, _ := jb.taskMap[taskName]
+			emails := t.Emails
+			if len(emails) == 0 {
+				emails = jb.Emails
+			}
+			cmdTemplateParams := map[string]interface{}{
+				"title":        jb.Title,
+				"scheduled_dt": run.ScheduledTime.Format("2006-01-02"),
+				"trigger_file": "",
+				"payload":      map[string]interface{}{},
+				"item":         "",
+			}
+			if jb.Matrix != nil {
+				cmdTemplateParams["matrix"] = jb.Matrix
+			}
+			for k, v := range params {
+				cmdTemplateParams[k] = v
+			}
+			retries := t.Retries
+			if retries == 0 {
+				retries = jb.Retries
+			}
+			timeout := t.TimeoutSec
+			if timeout == 0 {
+				timeout = jb.TaskTimeoutSec
+			}
+			retryDelay := t.RetryDelaySec
+			if retryDelay == 0 {
+				retryDelay = jb.RetryDelaySec
+			}
+			retryBackoff := t.RetryBackoff
+			if retryBackoff == 0 {
+				retryBackoff = jb.RetryBackoff
+			}
+			maxRetryDelay := t.MaxRetryDelaySec
+			if maxRetryDelay == 0 {
+				maxRetryDelay = jb.MaxRetryDelaySec
+			}
+			env := make(map[string]string, len(jb.Env)+len(t.Env))
+			for k, v := range jb.Env {
+				env[k] = v
+			}
+			for k, v := range t.Env {
+				env[k] = v
+			}
+			var envFiles []string
+			if jb.EnvFile != "" {
+				envFiles = append(envFiles, jb.EnvFile)
+			}
+			if t.EnvFile != "" {
+				envFiles = append(envFiles, t.EnvFile)
+			}
+			workdir := t.Workdir
+			if workdir == "" {
+				workdir = jb.Workdir
+			}
+			limits := newProcLimits(jb, t)
+			shell := t.Shell
+			if shell == "" {
+				shell = jb.Shell
+			}
+			if shell == "" {
+				shell = "/bin/bash"
+			}
+			workerLabels := t.WorkerLabels
+			if workerLabels == nil {
+				workerLabels = jb.WorkerLabels
+			}
+			host, sshUser := t.Host, t.SSHUser
+			if host == "" {
+				host, sshUser = jb.Host, jb.SSHUser
+			} else if sshUser == "" {
+				sshUser = jb.SSHUser
+			}
+			tr := &TaskRun{
+				Name:              t.Name,
+				jobTitle:          jb.Title,
+				Idx:               idx,
+				cmd:               t.Cmd,
+				Status:            NoRun,
+				Attempt:           0,
+				cmdTemplateParams: cmdTemplateParams,
+				retries:           retries,
+				timeout:           timeout,
+				emails:            emails,
+				Logfile:           "",
+				sensor:            newSensor(t),
+				deps:              jb.taskDeps[idx],
+				triggerRule:       t.TriggerRule,
+				allowFailure:      t.AllowFailure,
+				branches:          t.Branches,
+				foreach:           t.Foreach,
+				foreachCmd:        t.ForeachCmd,
+				maxParallel:       t.MaxParallel,
+				jobRun:            run,
+				subJob:            t.Job,
+				retryDelay:        retryDelay,
+				retryBackoff:      retryBackoff,
+				maxRetryDelay:     maxRetryDelay,
+				retryOn:           t.retryOn,
+				env:               env,
+				envFiles:          envFiles,
+				workdir:           workdir,
+				jobDir:            filepath.Dir(jb.file),
+				limits:            limits,
+				args:              t.Args,
+				shell:             shell,
+				script:            t.Script,
+				interpreter:       t.Interpreter,
+				workerLabels:      workerLabels,
+				host:              host,
+				sshUser:           sshUser,
+			}
+			tr.executor = newExecutor(tr, t.Args)
+			run.TasksHistory = append(run.TasksHistory, tr)
+			idx += 1
+		}
+	}
+	run.state = &runState{
+		title: jb.Title,
+		file:  run.StartTime.Format("20060102T150405.000000000") + ".json",
+		tasks: run.TasksHistory,
+	}
+	snapshotRun(run)
+	jb.RunHistory = append(jb.RunHistory, run)
+	return run
+}
+
+func runJob(run *JobRun, jb *Job) error {
+	if !ACTIVERUNS.add(run) {
+		infoLog.Printf("Not running '%s', shutting down", jb.Title)
+		run.Status = Interrupted
+		generateEvent("job_finished", run, nil)
+		return nil
+	}
+	defer ACTIVERUNS.done(run)
+	return runJobCtx(context.Background(), run, jb)
+}
+
+func runJobCtx(parentCtx context.Context, run *JobRun, jb *Job) error {
+	//todo: check race conditions
+	ctx, cancel := context.WithCancel(parentCtx)
+	run.ctxCancelFn = cancel
+	defer func() {
+		if run.ctxCancelFn != nil {
+			run.ctxCancelFn()
+			run.ctxCancelFn = nil
+		}
+	}()
+	run.Status = Running
+	infoLog.Printf("Running '%s'", jb.Title)
+	generateEvent("job_running", run, nil)
+	var jobFail, jobWarn bool
+	var mu sync.Mutex
+	skipTasks := make(map[string]bool)
+	var wg sync.WaitGroup
+	done := make([]chan struct{}, len(run.TasksHistory))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	for _, tr := range run.TasksHistory {
+		wg.Add(1)
+		go func(tr *TaskRun) {
+			defer wg.Done()
+			defer close(done[tr.Idx])
+			for _, d := range tr.deps {
+				select {
+				case <-done[d]:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			var err error
+			if run.resumed && tr.Status != NoRun {
+				err = resumeTask(ctx, tr)
+			} else {
+				depStatuses := make([]RunStatus, 0, len(tr.deps))
+				for _, d := range tr.deps {
+					depStatuses = append(depStatuses, run.TasksHistory[d].Status)
+				}
+				mu.Lock()
+				skip := skipTasks[tr.Name]
+				mu.Unlock()
+				if skip {
+					infoLog.Printf("Task '%s' skipped, branch not chosen", tr.Name)
+					tr.Status = Skipped
+					generateEvent("task_finished", nil, tr)
+					return
+				}
+				if ok, st := checkTriggerRule(tr.triggerRule, depStatuses); !ok {
+					infoLog.Printf("Task '%s' not run, trigger rule '%s' not satisfied", tr.Name, tr.triggerRule)
+					tr.Status = st
+					generateEvent("task_finished", nil, tr)
+					return
+				}
+				err = runTaskWithRetries(ctx, tr)
+			}
+			mu.Lock()
+			for name := range skippedBranches(tr) {
+				skipTasks[name] = true
+			}
+			if tr.Status == FailedAllowed {
+				jobWarn = true
+			} else if err != nil {
+				jobFail = true
+			}
+			mu.Unlock()
+		}(tr)
+	}
+	wg.Wait()
+	run.resumed = false
+	run.Status = RunSuccess
+	if jobFail {
+		run.Status = RunFailure
+		for _, tr := range run.TasksHistory {
+			if tr.Status == Interrupted {
+				run.Status = Interrupted
+			}
+		}
+	} else if jobWarn {
+		run.Status = SuccessWithWarnings
+	}
+	run.EndTime = time.Now()
+	generateEvent("job_finished", run, nil)
+	//todo: return error
+	return nil
+}
+
+var triggerRules = []string{"all_success", "all_done", "one_failed", "all_failed", "none_failed"}
+
+// checkTriggerRule decides whether a task runs given the final statuses of its dependencies.
+// If not, it returns the status for the task: Skipped if no dependency failed, UpstreamFailed otherwise.
+func checkTriggerRule(rule string, depStatuses []RunStatus) (bool, RunStatus) {
+	var succeeded, failed, skipped int
+	for _, st := range depStatuses {
+		if st == RunSuccess || st == FailedAllowed {
+			succeeded += 1
+		} else if st == Skipped {
+			skipped += 1
+		} else {
+			failed += 1
+		}
+	}
+	var ok bool
+	switch rule {
+	case "", "all_success":
+		ok = succeeded == len(depStatuses)
+	case "all_done":
+		ok = true
+	case "one_failed":
+		ok = failed > 0 || len(depStatuses) == 0
+	case "all_failed":
+		ok = failed == len(depStatuses)
+	case "none_failed":
+		ok = failed == 0
+	}
+	if ok {
+		return true, NoRun
+	} else if failed > 0 {
+		return false, UpstreamFailed
+	}
+	return false, Skipped
+}
+
+func runTaskWithRetries(ctx context.Context, tr *TaskRun) error {
+	if isMapped(tr) {
+		// items are retried individually
+		err := runMappedTask(ctx, tr)
+		markAllowedFailure(tr, err)
+		return err
+	}
+	var lastErr error
+	// resumed tasks continue after their last attempt
+	for attempt := tr.Attempt + 1; attempt <= tr.retries+1; attempt++ {
+		infoLog.Printf("Running task '%s' (attempt %d/%d)", tr.Name, attempt, tr.retries+1)
+		lastErr = runTask(ctx, tr)
+		retry, reason := retryDecision(tr, lastErr, attempt)
+		recordAttempt(tr, retry, reason)
+		if lastErr == nil {
+			break
+		} else if lastErr == context.Canceled {
+			infoLog.Printf("Task '%s' cancelled", tr.Name)
+			break
+		}
+		errorLog.Printf("Task '%s' failed (attempt %d/%d): %s", tr.Name, attempt, tr.retries+1, reason)
+		if !retry {
+			break
+		}
+		if delay := retryDelay(tr, attempt); delay > 0 {
+			if err := waitRetry(ctx, tr, delay); err != nil {
+				infoLog.Printf("Task '%s' cancelled", tr.Name)
+				lastErr = err
+				break
+			}
+		}
+	}
+	markAllowedFailure(tr, lastErr)
+	return lastErr
+}
+
+// retryDecision decides whether a failed attempt is retried and explains why.
+func retryDecision(tr *TaskRun, err error, attempt int) (bool, string) {
+	if err == nil {
+		return false, "succeeded"
+	} else if err == context.Canceled {
+		return false, "cancelled"
+	} else if attempt > tr.retries {
+		return false, "no retries left"
+	}
+	c := tr.retryOn
+	if c == nil {
+		return true, "failed"
+	}
+	if containsInt(c.noExitCodes, tr.ExitCode) {
+		return false, fmt.Sprintf("exit code %d is in no_retry_on_exit_codes", tr.ExitCode)
+	}
+	if c.noOutput != nil && c.noOutput.MatchString(tr.output) {
+		return false, "output matches no_retry_on_output"
+	}
+	if c.exitCodes == nil && c.output == nil {
+		return true, "failed"
+	}
+	if containsInt(c.exitCodes, tr.ExitCode) {
+		return true, fmt.Sprintf("exit code %d is in retry_on_exit_codes", tr.ExitCode)
+	}
+	if c.output != nil && c.output.MatchString(tr.output) {
+		return true, "output matches retry_on_output"
+	}
+	return false, fmt.Sprintf("exit code %d and output don't match retry_on_exit_codes or retry_on_output", tr.ExitCode)
+}
+
+func recordAttempt(tr *TaskRun, retry bool, reason string) {
+	tr.Attempts = append(tr.Attempts, &TaskAttempt{
+		Attempt:       tr.Attempt,
+		StartTime:     tr.StartTime,
+		EndTime:       tr.EndTime,
+		Status:        tr.Status,
+		ExitCode:      tr.ExitCode,
+		Retry:         retry,
+		RetryReason:   reason,
+		FailureReason: tr.FailureReason,
+	})
+	tr.output = ""
+}
+
+// newRetryConditions compiles retry_on_* and no_retry_on_* settings of a task, nil if there are none.
+func newRetryConditions(t *Task) (*retryConditions, error) {
+	if t.RetryOnExitCodes == nil && t.RetryOnOutput == "" && t.NoRetryOnExitCodes == nil && t.NoRetryOnOutput == "" {
+		return nil, nil
+	}
+	c := &retryConditions{
+		exitCodes:   t.RetryOnExitCodes,
+		noExitCodes: t.NoRetryOnExitCodes,
+	}
+	var err error
+	if t.RetryOnOutput != "" {
+		if c.output, err = regexp.Compile(t.RetryOnOutput); err != nil {
+			return nil, fmt.Errorf("bad retry_on_output: %v", err)
+		}
+	}
+	if t.NoRetryOnOutput != "" {
+		if c.noOutput, err = regexp.Compile(t.NoRetryOnOutput); err != nil {
+			return nil, fmt.Errorf("bad no_retry_on_output: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// retryDelay returns retry_delay * retry_backoff^(attempt-1) capped by max_retry_delay.
+func retryDelay(tr *TaskRun, attempt int) time.Duration {
+	delay := float64(tr.retryDelay)
+	if tr.retryBackoff > 0 {
+		delay *= math.Pow(tr.retryBackoff, float64(attempt-1))
+	}
+	if tr.maxRetryDelay > 0 && delay > float64(tr.maxRetryDelay) {
+		delay = float64(tr.maxRetryDelay)
+	}
+	// without max_retry_delay the backoff overflows a Duration after a few dozen attempts
+	if delay*float64(time.Second) >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay * float64(time.Second))
+}
+
+func waitRetry(ctx context.Context, tr *TaskRun, delay time.Duration) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	waitCtx, cancelFunc := context.WithCancel(ctx)
+	tr.ctxCancelFn = cancelFunc
+	defer func() {
+		if tr.ctxCancelFn != nil {
+			tr.ctxCancelFn()
+			tr.ctxCancelFn = nil
+		}
+	}()
+	tr.Status = WaitingRetry
+	tr.NextAttempt = time.Now().Add(delay)
+	infoLog.Printf("Task '%s' retries at %s", tr.Name, tr.NextAttempt.Format(time.RFC3339))
+	generateEvent("task_waiting_retry", nil, tr)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	defer func() { tr.NextAttempt = time.Time{} }()
+	select {
+	case <-timer.C:
+		return nil
+	case <-waitCtx.Done():
+		tr.Status = RunFailure
+		return waitCtx.Err()
+	}
+}
+
+// markAllowedFailure keeps failures of allow_failure tasks from failing the job.
+// Cancellations still count as failures.
+func markAllowedFailure(tr *TaskRun, err error) {
+	if err != nil && err != context.Canceled && tr.allowFailure && tr.Status == RunFailure {
+		infoLog.Printf("Task '%s' failed, failure allowed", tr.Name)
+		tr.Status = FailedAllowed
+		generateEvent("task_finished", nil, tr)
+	}
+}
+
+func runTask(ctx context.Context, tr *TaskRun) error {
+	if isMapped(tr) {
+		return runMappedTask(ctx, tr)
+	} else if tr.sensor != nil {
+		return runSensor(ctx, tr)
+	} else if tr.subJob != "" {
+		return runSubJob(ctx, tr)
+	}
+	c := &execCommand{limits: tr.limits}
+	var err error
+	var script, scriptFile string
+	if tr.script != "" {
+		if script, err = renderCmdTemplate(tr, tr.script); err != nil {
+			return err
+		}
+		if scriptFile, err = writeScript(tr, script); err != nil {
+			errorLog.Printf("Failed to write script of '%s'-'%s': %v\n", tr.jobTitle, tr.Name, err)
+			return err
+		}
+		defer os.Remove(scriptFile)
+		c.args = scriptArgs(tr, script, scriptFile)
+		c.command = c.String()
+		c.script = script
+	} else if tr.args != nil {
+		c.args = make([]string, len(tr.args))
+		for i, arg := range tr.args {
+			if c.args[i], err = renderCmdTemplate(tr, arg); err != nil {
+				return err
+			}
+		}
+	} else if c.command, err = renderCmdTemplate(tr, tr.cmd); err != nil {
+		return err
+	}
+	rendered := c.String()
+	env, err := taskEnv(tr)
+	if err != nil {
+		return err
+	}
+	c.dir = tr.Workdir
+	tr.StartTime = time.Now()
+	tr.Attempt += 1
+	tr.RenderedCmd = redactSecrets(tr, rendered)
+	tr.RenderedScript = redactSecrets(tr, script)
+	tr.Status = Running
+	tr.ExitCode = 0
+	tr.Branch = ""
+	tr.FailureReason = ""
+	//
+	var execCtx context.Context
+	var timeoutFunc context.CancelFunc
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	cancelCtx, cancelFunc := context.WithCancel(ctx)
+	if tr.timeout > 0 {
+		execCtx, timeoutFunc = context.WithTimeout(cancelCtx, time.Duration(tr.timeout)*time.Second)
+	} else {
+		execCtx = cancelCtx
+		timeoutFunc = func() {}
+	}
+	tr.ctxCancelFn = func() {
+		timeoutFunc()
+		cancelFunc()
+	}
+	defer func() {
+		if tr.ctxCancelFn != nil {
+			tr.ctxCancelFn()
+			tr.ctxCancelFn = nil
+		}
+	}()
+	generateEvent("task_running", nil, tr)
+	outputFile := ""
+	if f, err := os.CreateTemp("", "repeater_output_*"); err == nil {
+		f.Close()
+		outputFile = f.Name()
+		defer os.Remove(outputFile)
+		chownRunAs(tr, outputFile)
+	} else {
+		errorLog.Printf("Failed to create output file for '%s'-'%s': %v\n", tr.jobTitle, tr.Name, err)
+	}
+	c.env = env
+	c.outputFile = outputFile
+	if CONF.adoptTasks {
+		c.started = func(p *taskProcess) {
+			p.TempFiles = []string{outputFile, scriptFile}
+			tr.Process = p
+			generateEvent("task_running", nil, tr)
+		}
+	}
+	logFile := openTaskLog(tr)
+	if logFile != nil {
+		c.output = logFile
+	}
+	output, err := tr.executor.Execute(execCtx, c)
+	tr.Process = nil
+	logFile.Close()
+	return finishTask(execCtx, tr, output, outputFile, err)
+}
+
+// taskLog writes the output of a running task to its log file as it's produced.
+// Secrets are redacted line by line.
+type taskLog struct {
+	tr  *TaskRun
+	f   *os.File
+	buf []byte
+	mu  sync.Mutex
+}
+
+// openTaskLog creates the log file of a task attempt, nil if logs are disabled or on errors.
+func openTaskLog(tr *TaskRun) *taskLog {
+	if CONF.logsDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(CONF.logsDir, 0755); err != nil {
+		errorLog.Printf("Failed to create logs directory %s: %v", CONF.logsDir, err)
+		return nil
+	}
+	tr.Logfile = taskLogfile(tr)
+	// appends so that writes after the final output is saved don't leave holes
+	f, err := os.OpenFile(filepath.Join(CONF.logsDir, tr.Logfile), os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		errorLog.Printf("Failed to create log file %s: %v", tr.Logfile, err)
+		return nil
+	}
+	return &taskLog{tr: tr, f: f}
+}
+
+func (l *taskLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return len(p), nil
+	}
+	l.buf = append(l.buf, p...)
+	i := bytes.LastIndexByte(l.buf, '\n')
+	if i < 0 && len(l.buf) > 64*1024 {
+		i = len(l.buf) - 1
+	}
+	if i >= 0 {
+		l.f.WriteString(redactSecrets(l.tr, string(l.buf[:i+1])))
+		l.buf = append(l.buf[:0], l.buf[i+1:]...)
+	}
+	return len(p), nil
+}
+
+// Close writes the last incomplete line, later writes are dropped.
+func (l *taskLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	l.f.WriteString(redactSecrets(l.tr, string(l.buf)))
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// followFile copies what is appended to the file to w until stop is closed.
+func followFile(path string, w io.Writer, stop <-chan struct{}) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		io.Copy(w, f)
+		select {
+		case <-stop:
+			io.Copy(w, f)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// finishTask records the result of a task process.
+func finishTask(execCtx context.Context, tr *TaskRun, output string, outputFile string, err error) error {
+	tr.EndTime = time.Now()
+	tr.ExitCode = exitCode(err)
+	tr.output = output
+	outputs := parseOutputs(output, outputFile)
+	for k, v := range outputs {
+		outputs[k] = redactSecrets(tr, v)
+	}
+	publishOutputs(tr, outputs)
+	if tr.branches != nil && execCtx.Err() == nil {
+		key := branchKey(output, tr.ExitCode)
+		_, ok := tr.branches[key]
+		if _, hasDefault := tr.branches["default"]; !ok && hasDefault && err == nil {
+			key, ok = "default", true
+		}
+		if ok {
+			infoLog.Printf("Task '%s'-'%s' chose branch '%s'", tr.jobTitle, tr.Name, key)
+			tr.Branch = key
+			err = nil
+		} else if err == nil {
+			// running every branch would run paths meant to exclude each other
+			err = fmt.Errorf("outcome '%s' matches no branch", key)
+		}
+	}
+	if err != nil {
+		var limitErr *limitError
+		if errors.As(err, &limitErr) {
+			tr.FailureReason = limitErr.reason
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			tr.FailureReason = fmt.Sprintf("timeout of %d seconds exceeded", tr.timeout)
+		}
+		errorLog.Printf("Error executing '%s'-'%s': %v\n", tr.jobTitle, tr.Name, err)
+		output = output + "\nERROR: " + err.Error()
+	}
+	// saved before the status changes for clients following the log
+	saveOutputOnDisk(output, tr)
+	if err != nil {
+		tr.Status = RunFailure
+		notifyTaskFailure(tr)
+	} else {
+		tr.Status = RunSuccess
+	}
+	generateEvent("task_finished", nil, tr)
+	return err
+}
+
+// writeScript writes a rendered script to a temp file for an attempt.
+func writeScript(tr *TaskRun, script string) (string, error) {
+	f, err := os.CreateTemp("", "repeater_script_*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(script)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0700)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	chownRunAs(tr, f.Name())
+	return f.Name(), nil
+}
+
+// scriptArgs runs a script file with the interpreter, directly if it starts with a shebang,
+// otherwise with the shell of the task.
+func scriptArgs(tr *TaskRun, script string, scriptFile string) []string {
+	if tr.interpreter != "" {
+		return append(strings.Fields(tr.interpreter), scriptFile)
+	} else if strings.HasPrefix(script, "#!") {
+		return []string{scriptFile}
+	}
+	return []string{tr.shell, scriptFile}
+}
+
+// chownRunAs gives a file created for a task run to its run_as user.
+func chownRunAs(tr *TaskRun, path string) {
+	if tr.limits == nil || tr.limits.runAs == "" {
+		return
+	}
+	if cred, _, err := lookupCredential(tr.limits.runAs); err == nil {
+		os.Chown(path, int(cred.Uid), int(cred.Gid))
+	}
+}
+
+const maxSubJobDepth = 10
+
+// runSubJob starts a run of another job with the same scheduled time and params
+// and waits for it to finish.
+func runSubJob(ctx context.Context, tr *TaskRun) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	subCtx, cancelFunc := context.WithCancel(ctx)
+	tr.ctxCancelFn = cancelFunc
+	defer func() {
+		if tr.ctxCancelFn != nil {
+			tr.ctxCancelFn()
+			tr.ctxCancelFn = nil
+		}
+	}()
+	tr.StartTime = time.Now()
+	tr.Attempt += 1
+	tr.RenderedCmd = "job: " + tr.subJob
+	tr.SubJobRun = nil
+	tr.Status = Running
+	generateEvent("task_running", nil, tr)
+	var err error
+	var output string
+	jb := findJobByTitle(tr.subJob)
+	if jb == nil {
+		err = fmt.Errorf("job '%s' not found", tr.subJob)
+	} else if tr.jobRun.depth >= maxSubJobDepth {
+		err = fmt.Errorf("too many nested jobs (%d)", maxSubJobDepth)
+	} else {
+		params := make(map[string]interface{}, len(tr.cmdTemplateParams))
+		for k, v := range tr.cmdTemplateParams {
+			// the other job has its own title, matrix and items
+			if k != "title" && k != "scheduled_dt" && k != "matrix" && k != "item" {
+				params[k] = v
+			}
+		}
+		run := initRun(jb, tr.jobRun.ScheduledTime, params)
+		run.depth = tr.jobRun.depth + 1
+		tr.SubJobRun = &jobRunRef{JobId: jb.Id, RunIdx: run.Idx, Job: jb.Title, File: run.state.file}
+		// saves the reference, so that the task waits for the run if it's resumed
+		generateEvent("task_running", nil, tr)
+		infoLog.Printf("Task '%s'-'%s' started job '%s'", tr.jobTitle, tr.Name, jb.Title)
+		runJobCtx(subCtx, run, jb)
+		output, err = subJobResult(subCtx, jb, run)
+	}
+	return finishSubJob(tr, output, err)
+}
+
+// resumeSubJob resumes the run a job task started before a restart and records its result.
+func resumeSubJob(ctx context.Context, tr *TaskRun, run *JobRun) error {
+	subCtx, cancelFunc := context.WithCancel(ctx)
+	tr.ctxCancelFn = cancelFunc
+	defer func() {
+		if tr.ctxCancelFn != nil {
+			tr.ctxCancelFn()
+			tr.ctxCancelFn = nil
+		}
+	}()
+	jb := findJobByTitle(tr.SubJobRun.Job)
+	tr.SubJobRun = &jobRunRef{JobId: jb.Id, RunIdx: run.Idx, Job: jb.Title, File: run.state.file}
+	if run.Status == Running {
+		infoLog.Printf("Task '%s'-'%s' resumed run %d of '%s'", tr.jobTitle, tr.Name, run.Idx, jb.Title)
+		run.depth = tr.jobRun.depth + 1
+		run.resumed = true
+		runJobCtx(subCtx, run, jb)
+	}
+	output, err := subJobResult(subCtx, jb, run)
+	return finishSubJob(tr, output, err)
+}
+
+// subJobResult returns the output and the error of a job task from the run it started.
+func subJobResult(ctx context.Context, jb *Job, run *JobRun) (string, error) {
+	output := fmt.Sprintf("Job '%s' run %d: %s\n", jb.Title, run.Idx, statusName(run.Status))
+	if ctx.Err() != nil {
+		return output, ctx.Err()
+	} else if run.Status != RunSuccess && run.Status != SuccessWithWarnings {
+		return output, fmt.Errorf("job '%s' failed", jb.Title)
+	}
+	return output, nil
+}
+
+func finishSubJob(tr *TaskRun, output string, err error) error {
+	tr.EndTime = time.Now()
+	if err != nil {
+		errorLog.Printf("Error running job '%s' from '%s'-'%s': %v\n", tr.subJob, tr.jobTitle, tr.Name, err)
+		output = output + "\nERROR: " + err.Error()
+		tr.Status = RunFailure
+		notifyTaskFailure(tr)
+	} else {
+		tr.Status = RunSuccess
+	}
+	saveOutputOnDisk(output, tr)
+	generateEvent("task_finished", nil, tr)
+	return err
+}
+
+// subJobRun returns the run started by a job task, nil if there is none.
+func subJobRun(tr *TaskRun) *JobRun {
+	ref := tr.SubJobRun
+	if ref == nil {
+		return nil
+	}
+	jb := findJobByTitle(ref.Job)
+	if jb == nil {
+		return nil
+	}
+	for _, run := range jb.RunHistory {
+		if run.state.file == ref.File {
+			return run
+		}
+	}
+	return nil
+}
+
+func isMapped(tr *TaskRun) bool {
+	return tr.foreach != nil || tr.foreachCmd != ""
+}
+
+// runMappedTask expands a foreach task into one TaskRun per item
+// and runs them with at most maxParallel at a time.
+func runMappedTask(ctx context.Context, tr *TaskRun) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	mapCtx, cancelFunc := context.WithCancel(ctx)
+	tr.ctxCancelFn = cancelFunc
+	defer func() {
+		if tr.ctxCancelFn != nil {
+			tr.ctxCancelFn()
+			tr.ctxCancelFn = nil
+		}
+	}()
+	tr.StartTime = time.Now()
+	tr.Attempt += 1
+	tr.Status = Running
+	tr.Items = nil
+	generateEvent("task_running", nil, tr)
+	items, output, err := mappedItems(mapCtx, tr)
+	if err != nil {
+		errorLog.Printf("Error listing items of '%s'-'%s': %v\n", tr.jobTitle, tr.Name, err)
+		tr.EndTime = time.Now()
+		tr.Status = RunFailure
+		saveOutputOnDisk(output+"\nERROR: "+err.Error(), tr)
+		notifyTaskFailure(tr)
+		generateEvent("task_finished", nil, tr)
+		return err
+	}
+	for i, item := range items {
+		params := make(map[string]interface{}, len(tr.cmdTemplateParams)+1)
+		for k, v := range tr.cmdTemplateParams {
+			params[k] = v
+		}
+		params["item"] = item
+		tr.Items = append(tr.Items, &TaskRun{
+			Idx:               i,
+			Name:              tr.Name + "[" + item + "]",
+			jobTitle:          tr.jobTitle,
+			cmd:               tr.cmd,
+			Status:            NoRun,
+			cmdTemplateParams: params,
+			emails:            tr.emails,
+			retries:           tr.retries,
+			timeout:           tr.timeout,
+			Item:              item,
+			jobRun:            tr.jobRun,
+			deps:              tr.deps,
+			retryDelay:        tr.retryDelay,
+			retryBackoff:      tr.retryBackoff,
+			maxRetryDelay:     tr.maxRetryDelay,
+			retryOn:           tr.retryOn,
+			env:               tr.env,
+			envFiles:          tr.envFiles,
+			workdir:           tr.workdir,
+			jobDir:            tr.jobDir,
+			limits:            tr.limits,
+			args:              tr.args,
+			shell:             tr.shell,
+			executor:          tr.executor,
+			script:            tr.script,
+			interpreter:       tr.interpreter,
+			workerLabels:      tr.workerLabels,
+			host:              tr.host,
+			sshUser:           tr.sshUser,
+		})
+	}
+	generateEvent("task_running", nil, tr)
+	limit := tr.maxParallel
+	if limit <= 0 {
+		limit = len(tr.Items)
+	}
+	sem := make(chan struct{}, limit)
+	errCh := make(chan error, len(tr.Items))
+	var wg sync.WaitGroup
+	for _, child := range tr.Items {
+		wg.Add(1)
+		go func(child *TaskRun) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-mapCtx.Done():
+				errCh <- mapCtx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			if err := runTaskWithRetries(mapCtx, child); err != nil {
+				errCh <- err
+			}
+		}(child)
+	}
+	wg.Wait()
+	close(errCh)
+	tr.EndTime = time.Now()
+	var sb strings.Builder
+	sb.WriteString(output)
+	for _, child := range tr.Items {
+		fmt.Fprintf(&sb, "%s: %s\n", child.Item, statusName(child.Status))
+	}
+	err = nil
+	if mapCtx.Err() != nil {
+		err = mapCtx.Err()
+	} else if len(errCh) > 0 {
+		err = fmt.Errorf("%d of %d items failed", len(errCh), len(tr.Items))
+	}
+	if err != nil {
+		sb.WriteString("\nERROR: " + err.Error())
+		tr.Status = RunFailure
+	} else {
+		tr.Status = RunSuccess
+	}
+	saveOutputOnDisk(sb.String(), tr)
+	generateEvent("task_finished", nil, tr)
+	return err
+}
+
+// mappedItems returns the foreach list or the non-empty output lines of foreach_cmd.
+func mappedItems(ctx context.Context, tr *TaskRun) ([]string, string, error) {
+	if tr.foreachCmd == "" {
+		return tr.foreach, "", nil
+	}
+	rendered, err := renderCmdTemplate(tr, tr.foreachCmd)
+	if err != nil {
+		return nil, "", err
+	}
+	env, err := taskEnv(tr)
+	if err != nil {
+		return nil, "", err
+	}
+	tr.RenderedCmd = redactSecrets(tr, rendered)
+	if tr.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(tr.timeout)*time.Second)
+		defer cancel()
+	}
+	output, err := newExecutor(tr, nil).Execute(ctx, &execCommand{command: rendered, dir: tr.Workdir, env: env, limits: tr.limits})
+	if err != nil {
+		return nil, output, err
+	}
+	var items []string
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			items = append(items, line)
+		}
+	}
+	return items, output + "\n", nil
+}
+
+func statusName(status RunStatus) string {
+	names := []string{"success", "failure", "running", "not run", "waiting", "skipped", "upstream failed",
+		"failure allowed", "success with warnings", "waiting to retry", "interrupted"}
+	if int(status) < len(names) {
+		return names[status]
+	}
+	return "unknown"
+}
+
+func exitCode(err error) int {
+	var exitErr interface{ ExitCode() int }
+	if err == nil {
+		return 0
+	} else if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// branchKey returns the value of the last "::branch <key>" output line
+// or the exit code if there is no such line.
+func branchKey(output string, exitCode int) string {
+	key := strconv.Itoa(exitCode)
+	for _, line := range strings.Split(output, "\n") {
+		if v, ok := cutPrefix(strings.TrimSpace(line), "::branch "); ok {
+			key = strings.TrimSpace(v)
+		}
+	}
+	return key
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// skippedBranches returns the targets of all branches of tr except the chosen one.
+func skippedBranches(tr *TaskRun) map[string]bool {
+	skipped := make(map[string]bool)
+	if tr.Branch == "" {
+		return skipped
+	}
+	for _, targets := range tr.branches {
+		for _, t := range targets {
+			skipped[t] = true
+		}
+	}
+	for _, t := range tr.branches[tr.Branch] {
+		delete(skipped, t)
+	}
+	return skipped
+}
+
+func renderCmdTemplate(tr *TaskRun, text string) (string, error) {
+	tmpl := texttemplate.New("tmpl").Option("missingkey=error").Funcs(texttemplate.FuncMap{
+		"secret": func(name string) (string, error) {
+			value, err := SECRETS.get(name)
+			if err == nil && value != "" && !containsString(tr.secrets, value) {
+				tr.secrets = append(tr.secrets, value)
+			}
+			return value, err
+		},
+	})
+	tmpl, err := tmpl.Parse(text)
+	if err != nil {
+		errorLog.Printf("Error parsing command template '%s'-'%s'-'%s': %v\n", tr.jobTitle, tr.Name, text, err)
+		return "", err
+	}
+	sb := new(strings.Builder)
+	params := make(map[string]interface{}, len(tr.cmdTemplateParams)+1)
+	for k, v := range tr.cmdTemplateParams {
+		params[k] = v
+	}
+	params["outputs"] = upstreamOutputs(tr)
+	err = tmpl.Execute(sb, params)
+	if err != nil {
+		errorLog.Printf("Error rendering command template '%s'-'%s'-'%s': %v\n", tr.jobTitle, tr.Name, text, err)
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// redactSecrets replaces values of secrets used by the task run.
+func redactSecrets(tr *TaskRun, s string) string {
+	for _, value := range tr.secrets {
+		s = strings.ReplaceAll(s, value, "***")
+	}
+	return s
+}
+
+// publishOutputs sets the values published by a finished task.
+func publishOutputs(tr *TaskRun, outputs map[string]string) {
+	if tr.jobRun == nil {
+		tr.Outputs = outputs
+		return
+	}
+	tr.jobRun.outputsMu.Lock()
+	defer tr.jobRun.outputsMu.Unlock()
+	tr.Outputs = outputs
+}
+
+// upstreamOutputs collects copies of the values published by the finished tasks
+// tr depends on, directly or through other tasks, by task name.
+func upstreamOutputs(tr *TaskRun) map[string]map[string]string {
+	outputs := make(map[string]map[string]string)
+	run := tr.jobRun
+	if run == nil {
+		return outputs
+	}
+	run.outputsMu.Lock()
+	defer run.outputsMu.Unlock()
+	seen := make(map[int]bool)
+	deps := append([]int(nil), tr.deps...)
+	for len(deps) > 0 {
+		d := deps[0]
+		deps = deps[1:]
+		if seen[d] || d >= len(run.TasksHistory) {
+			continue
+		}
+		seen[d] = true
+		upstream := run.TasksHistory[d]
+		if upstream.Outputs != nil {
+			values := make(map[string]string, len(upstream.Outputs))
+			for k, v := range upstream.Outputs {
+				values[k] = v
+			}
+			outputs[upstream.Name] = values
+		}
+		deps = append(deps, upstream.deps...)
+	}
+	return outputs
+}
+
+// parseOutputs reads "::set key=value" lines of the task output
+// and "key=value" lines of the file passed in REPEATER_OUTPUT.
+func parseOutputs(output string, outputFile string) map[string]string {
+	values := make(map[string]string)
+	parse := func(line string) {
+		if k, v, ok := strings.Cut(line, "="); ok && strings.TrimSpace(k) != "" {
+			values[strings.TrimSpace(k)] = strings.TrimRight(v, "\r")
+		}
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if kv, ok := cutPrefix(strings.TrimSpace(line), "::set "); ok {
+			parse(kv)
+		}
+	}
+	if data, err := os.ReadFile(outputFile); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			parse(line)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// taskEnv renders the working directory and environment variables of a task run.
+// Relative paths are resolved against the directory of the job file, which is also the default workdir.
+// Variables from env files come first, env takes precedence over them.
+// It sets Workdir and Env, with values from env files and of secret-like names masked,
+// and returns the variables to add to the environment of the command.
+// Tasks run by workers or over SSH have no default workdir and relative paths are resolved remotely.
+func taskEnv(tr *TaskRun) ([]string, error) {
+	workdir, err := renderCmdTemplate(tr, tr.workdir)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(workdir) && tr.workerLabels == nil && tr.host == "" {
+		workdir = filepath.Join(tr.jobDir, workdir)
+	}
+	tr.Workdir = workdir
+	vars := make(map[string]string)
+	masked := make(map[string]string)
+	for _, f := range tr.envFiles {
+		path, err := renderCmdTemplate(tr, f)
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(tr.jobDir, path)
+		}
+		fileVars, err := readEnvFile(path)
+		if err != nil {
+			errorLog.Printf("Error reading env_file of '%s'-'%s': %v\n", tr.jobTitle, tr.Name, err)
+			return nil, err
+		}
+		for k, v := range fileVars {
+			vars[k] = v
+			masked[k] = "***"
+		}
+	}
+	for k, v := range tr.env {
+		rendered, err := renderCmdTemplate(tr, v)
+		if err != nil {
+			return nil, err
+		}
+		vars[k] = rendered
+		masked[k] = redactSecrets(tr, rendered)
+		if secretEnvName.MatchString(k) {
+			masked[k] = "***"
+		}
+	}
+	tr.Env = nil
+	if len(masked) > 0 {
+		tr.Env = masked
+	}
+	var env []string
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	return env, nil
+}
+
+var secretEnvName = regexp.MustCompile(`(?i)pass|secret|token|key|credential|auth`)
+
+// readEnvFile reads KEY=value lines, skipping empty lines and # comments.
+// Values can be quoted, lines can start with export.
+func readEnvFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line, _ = cutPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, i+1)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		vars[k] = v
+	}
+	return vars, nil
+}
+
+// Executor runs rendered task commands and returns their combined output.
+type Executor interface {
+	Execute(ctx context.Context, c *execCommand) (string, error)
+}
+
+// execCommand is a rendered task command with the settings of its task run.
+type execCommand struct {
+	command    string   // for shell executors
+	args       []string // for the argv executor
+	script     string   // content of the script file, the last of args
+	dir        string
+	env        []string // added to the environment of the process
+	outputFile string   // set as REPEATER_OUTPUT
+	limits     *procLimits
+	output     io.Writer            // receives output while the command runs
+	started    func(p *taskProcess) // when set, the process survives restarts and is reported once started
+}
+
+// String returns the command as shown in RenderedCmd.
+func (c *execCommand) String() string {
+	if c.args == nil {
+		return c.command
+	}
+	quoted := make([]string, len(c.args))
+	for i, arg := range c.args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_./=:,+@%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// newExecutor returns the worker executor for tasks with worker labels,
+// the SSH executor for tasks with host, the argv executor for commands with args,
+// otherwise the shell executor.
+func newExecutor(tr *TaskRun, args []string) Executor {
+	if tr.workerLabels != nil {
+		return &workerExecutor{shell: tr.shell, labels: tr.workerLabels}
+	} else if tr.host != "" {
+		return &sshExecutor{
+			host:   tr.host,
+			user:   tr.sshUser,
+			shell:  tr.shell,
+			config: sshClientConfig,
+			dial:   (&net.Dialer{}).DialContext,
+		}
+	} else if args != nil {
+		return &argvExecutor{}
+	}
+	return &shellExecutor{shell: tr.shell}
+}
+
+// shellExecutor runs commands with `shell -c`.
+type shellExecutor struct {
+	shell string
+}
+
+func (e *shellExecutor) Execute(ctx context.Context, c *execCommand) (string, error) {
+	return runProcess(ctx, []string{e.shell, "-c", c.command}, c)
+}
+
+// argvExecutor runs args without a shell.
+type argvExecutor struct{}
+
+func (e *argvExecutor) Execute(ctx context.Context, c *execCommand) (string, error) {
+	return runProcess(ctx, c.args, c)
+}
+
+// runProcess runs argv in its own process group, with the user and limits of the command.
+// Rlimits are set by /bin/sh before it execs argv.
+func runProcess(ctx context.Context, argv []string, c *execCommand) (string, error) {
+	limits := c.limits
+	cgroup := newCgroup(limits)
+	if cgroup != "" {
+		defer removeCgroup(cgroup)
+	}
+	var proc *taskProcess
+	ulimit := ulimitPrefix(limits, cgroup != "")
+	if c.started != nil {
+		var err error
+		if proc, err = newTaskProcess(limits); err != nil {
+			return "", err
+		}
+		defer proc.remove()
+		// $0 is the exit file, the shell stays the group leader to record the exit code
+		argv = append([]string{"/bin/sh", "-c", ulimit + `"$@"; rc=$?; echo $rc > "$0"; exit $rc`, proc.ExitFile}, argv...)
+	} else if ulimit != "" {
+		argv = append([]string{"/bin/sh", "-c", ulimit + `exec "$@"`, "sh"}, argv...)
+	}
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Dir = c.dir
+	cmd.Env = append(os.Environ(), c.env...)
+	if c.outputFile != "" {
+		cmd.Env = append(cmd.Env, "REPEATER_OUTPUT="+c.outputFile)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+	if proc != nil {
+		cmd.SysProcAttr.Pdeathsig = 0
+	}
+	if limits != nil && limits.runAs != "" {
+		cred, userEnv, err := lookupCredential(limits.runAs)
+		if err != nil {
+			return "", err
+		}
+		cmd.SysProcAttr.Credential = cred
+		cmd.Env = append(cmd.Env, userEnv...)
+	}
+	if cgroup != "" {
+		// the process starts in the cgroup, so that nothing it forks escapes the limit
+		dir, err := os.Open(cgroup)
+		if err != nil {
+			return "", fmt.Errorf("failed to apply memory limit: %v", err)
+		}
+		defer dir.Close()
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	}
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	if proc != nil {
+		// the process writes to the file directly to outlive the pipe
+		f, err := os.OpenFile(proc.Output, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		cmd.Stdout = f
+	} else if c.output != nil {
+		cmd.Stdout = io.MultiWriter(&output, c.output)
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		if cgroup != "" {
+			return "", fmt.Errorf("failed to start in cgroup %s: %w", cgroup, err)
+		}
+		return "", err
+	}
+	if proc != nil {
+		proc.Pid = cmd.Process.Pid
+		proc.StartTicks, _ = procStartTicks(proc.Pid)
+		c.started(proc)
+		if c.output != nil {
+			stop, done := make(chan struct{}), make(chan struct{})
+			go func() {
+				followFile(proc.Output, c.output, stop)
+				close(done)
+			}()
+			defer func() {
+				close(stop)
+				<-done
+			}()
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}()
+	err := cmd.Wait()
+	if proc != nil {
+		data, _ := os.ReadFile(proc.Output)
+		output.Write(data)
+	}
+	reason := limitExceeded(cmd.ProcessState, limits, cgroup)
+	if ctx.Err() != nil {
+		return output.String(), ctx.Err()
+	}
+	if err != nil && reason != "" {
+		return output.String(), &limitError{reason: reason, err: err}
+	}
+	return output.String(), err
+}
+
+// taskProcess is a task process that outlives Repeater, adopted on the next start.
+// It writes its output and exit code to files in the state directory.
+type taskProcess struct {
+	Host       string
+	Pid        int
+	StartTicks uint64 // tells the process from another one with the same pid
+	Output     string
+	ExitFile   string
+	TempFiles  []string // of the attempt, removed by the adopter
+}
+
+func newTaskProcess(limits *procLimits) (*taskProcess, error) {
+	dir := filepath.Join(CONF.stateDir, "procs")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "task_*.out")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	host, _ := os.Hostname()
+	p := &taskProcess{Host: host, Output: f.Name(), ExitFile: strings.TrimSuffix(f.Name(), ".out") + ".rc"}
+	if err := os.WriteFile(p.ExitFile, nil, 0644); err != nil {
+		p.remove()
+		return nil, err
+	}
+	if limits != nil && limits.runAs != "" {
+		cred, _, err := lookupCredential(limits.runAs)
+		if err != nil {
+			p.remove()
+			return nil, err
+		}
+		os.Chown(p.ExitFile, int(cred.Uid), int(cred.Gid))
+	}
+	return p, nil
+}
+
+func (p *taskProcess) remove() {
+	os.Remove(p.Output)
+	os.Remove(p.ExitFile)
+}
+
+// alive checks that the process runs on this host and is still the one started for the task.
+func (p *taskProcess) alive() bool {
+	if host, _ := os.Hostname(); host != p.Host || p.Pid <= 0 {
+		return false
+	}
+	ticks, err := procStartTicks(p.Pid)
+	return err == nil && ticks == p.StartTicks
+}
+
+// wait polls the process until it's gone and returns its result from the exit file.
+// The process group is killed when ctx is done.
+func (p *taskProcess) wait(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for p.alive() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-p.Pid, syscall.SIGKILL)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	data, err := os.ReadFile(p.ExitFile)
+	if err != nil {
+		return err
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return errors.New("process ended without an exit code")
+	} else if code != 0 {
+		return &exitStatusError{code: code, msg: fmt.Sprintf("exit status %d", code)}
+	}
+	return nil
+}
+
+// procStartTicks returns the start time of a process in clock ticks after boot.
+func procStartTicks(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// the command name in parentheses can contain spaces
+	i := bytes.LastIndexByte(data, ')')
+	fields := strings.Fields(string(data[i+1:]))
+	if i < 0 || len(fields) < 20 {
+		return 0, errors.New("bad /proc stat")
+	}
+	if fields[0] == "Z" {
+		return 0, errors.New("zombie process")
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// procLimits are the user and resource limits of task processes.
+type procLimits struct {
+	runAs      string
+	memory     int64
+	cpuSeconds uint64
+	nofile     uint64
+}
+
+// limitError is returned for processes killed for exceeding a limit.
+type limitError struct {
+	reason string
+	err    error
+}
+
+func (e *limitError) Error() string {
+	return e.reason + ": " + e.err.Error()
+}
+
+func (e *limitError) Unwrap() error {
+	return e.err
+}
+
+// newProcLimits returns limits of a task, task values take precedence over job values.
+// It returns nil when there are no limits.
+func newProcLimits(jb *Job, t *Task) *procLimits {
+	limits := Limits{
+		Memory:     t.Limits.Memory,
+		CPUSeconds: t.Limits.CPUSeconds,
+		Nofile:     t.Limits.Nofile,
+	}
+	if limits.Memory == "" {
+		limits.Memory = jb.Limits.Memory
+	}
+	if limits.CPUSeconds == 0 {
+		limits.CPUSeconds = jb.Limits.CPUSeconds
+	}
+	if limits.Nofile == 0 {
+		limits.Nofile = jb.Limits.Nofile
+	}
+	runAs := t.RunAs
+	if runAs == "" {
+		runAs = jb.RunAs
+	}
+	if runAs == "" && limits == (Limits{}) {
+		return nil
+	}
+	memory, _ := parseSize(limits.Memory) // validated on load
+	return &procLimits{
+		runAs:      runAs,
+		memory:     memory,
+		cpuSeconds: uint64(limits.CPUSeconds),
+		nofile:     uint64(limits.Nofile),
+	}
+}
+
+func validateLimits(limits Limits) error {
+	if _, err := parseSize(limits.Memory); err != nil {
+		return err
+	}
+	if limits.CPUSeconds < 0 || limits.Nofile < 0 {
+		return errors.New("negative cpu_seconds or nofile limit")
+	}
+	return nil
+}
+
+// parseSize parses sizes like 512M or 2G with binary units. Empty size is 0.
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	if i := strings.IndexAny(s, "KMGT"); i == len(s)-1 {
+		multiplier = int64(1) << (10 * (strings.IndexByte("KMGT", s[i]) + 1))
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad memory limit \"%s\"", size)
+	}
+	return n * multiplier, nil
+}
+
+// lookupCredential returns credentials of a user for run_as
+// and HOME, USER and LOGNAME variables.
+func lookupCredential(name string) (*syscall.Credential, []string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, nil, err
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if groupIds, err := u.GroupIds(); err == nil {
+		for _, g := range groupIds {
+			if id, err := strconv.ParseUint(g, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(id))
+			}
+		}
+	}
+	env := []string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username}
+	return cred, env, nil
+}
+
+// ulimitPrefix returns shell commands setting rlimits, run after switching to the run_as user.
+// The memory limit uses the address space rlimit when there is no cgroup.
+func ulimitPrefix(limits *procLimits, cgroup bool) string {
+	if limits == nil {
+		return ""
+	}
+	var sb strings.Builder
+	if limits.cpuSeconds > 0 {
+		// SIGXCPU at the soft limit, SIGKILL at the hard one
+		fmt.Fprintf(&sb, "ulimit -S -t %d && ulimit -H -t %d && ", limits.cpuSeconds, limits.cpuSeconds+5)
+	}
+	if limits.nofile > 0 {
+		fmt.Fprintf(&sb, "ulimit -n %d && ", limits.nofile)
+	}
+	if limits.memory > 0 && !cgroup {
+		fmt.Fprintf(&sb, "ulimit -v %d && ", limits.memory/1024)
+	}
+	return sb.String()
+}
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+var cgroupCounter uint64
+
+var cgroupParent struct {
+	once sync.Once
+	dir  string
+}
+
+// taskCgroupParent returns the cgroup Repeater runs in, where task cgroups are created.
+// It must be delegated to Repeater, e.g. with Delegate=yes in a systemd unit.
+// Processes can't stay in a cgroup that enables controllers for its children,
+// so Repeater first moves itself to a "repeater" child.
+// It returns "" if cgroup v2 with the memory controller is not available.
+func taskCgroupParent() string {
+	cgroupParent.once.Do(func() {
+		data, err := os.ReadFile("/proc/self/cgroup")
+		if err != nil {
+			return
+		}
+		var path string
+		for _, line := range strings.Split(string(data), "\n") {
+			if p, ok := cutPrefix(line, "0::"); ok {
+				path = p
+			}
+		}
+		dir := filepath.Join(cgroupRoot, path)
+		controllers, err := os.ReadFile(filepath.Join(dir, "cgroup.controllers"))
+		if path == "" || err != nil || !containsString(strings.Fields(string(controllers)), "memory") {
+			return
+		}
+		leaf := filepath.Join(dir, "repeater")
+		if err := os.Mkdir(leaf, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			errorLog.Printf("Failed to create cgroup %s, memory limits use rlimits: %v", leaf, err)
+			return
+		}
+		if err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			errorLog.Printf("Failed to move to cgroup %s, memory limits use rlimits: %v", leaf, err)
+			return
+		}
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory"), 0644); err != nil {
+			errorLog.Printf("Failed to enable the memory controller in %s, memory limits use rlimits: %v", dir, err)
+			return
+		}
+		cgroupParent.dir = dir
+	})
+	return cgroupParent.dir
+}
+
+// newCgroup creates a cgroup v2 with memory.max for a task process.
+// It returns "" if there is no memory limit or cgroup v2 with the memory controller is not available.
+func newCgroup(limits *procLimits) string {
+	if limits == nil || limits.memory <= 0 {
+		return ""
+	}
+	parent := taskCgroupParent()
+	if parent == "" {
+		return ""
+	}
+	dir := filepath.Join(parent, fmt.Sprintf("task_%d_%d", os.Getpid(), atomic.AddUint64(&cgroupCounter, 1)))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return ""
+	}
+	if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.FormatInt(limits.memory, 10)), 0644); err != nil {
+		os.Remove(dir)
+		return ""
+	}
+	return dir
+}
+
+func removeCgroup(dir string) {
+	if err := os.Remove(dir); err != nil {
+		errorLog.Printf("Failed to remove cgroup %s: %v", dir, err)
+	}
+}
+
+// limitExceeded returns the limit a finished process was killed for, if any.
+func limitExceeded(state *os.ProcessState, limits *procLimits, cgroup string) string {
+	if limits == nil || state == nil {
+		return ""
+	}
+	if cgroup != "" {
+		events, _ := os.ReadFile(filepath.Join(cgroup, "memory.events"))
+		for _, line := range strings.Split(string(events), "\n") {
+			if n, ok := cutPrefix(line, "oom_kill "); ok && n != "0" {
+				return fmt.Sprintf("memory limit of %d bytes exceeded", limits.memory)
+			}
+		}
+	}
+	if limits.cpuSeconds > 0 {
+		status, _ := state.Sys().(syscall.WaitStatus)
+		cpu := state.UserTime() + state.SystemTime()
+		xcpu := status.Signaled() && status.Signal() == syscall.SIGXCPU || state.ExitCode() == 128+int(syscall.SIGXCPU)
+		if xcpu || cpu >= time.Duration(limits.cpuSeconds)*time.Second {
+			return fmt.Sprintf("cpu time limit of %d seconds exceeded", limits.cpuSeconds)
+		}
+	}
+	return ""
+}
+
+var errSensorTimeout = errors.New("sensor timed out")
+
+func isSensorTask(t *Task) bool {
+	return t.SensorCmd != "" || t.SensorFile != "" || t.SensorHTTP != ""
+}
+
+func validateSensor(t *Task) error {
+	n := 0
+	for _, c := range []string{t.Cmd, strings.Join(t.Args, " "), t.Script, t.SensorCmd, t.SensorFile, t.SensorHTTP, t.Job} {
+		if c != "" {
+			n += 1
+		}
+	}
+	if n > 1 {
+		return errors.New("only one of cmd, args, script, sensor_cmd, sensor_file, sensor_http and job can be set")
+	}
+	if t.Interpreter != "" && t.Script == "" {
+		return errors.New("interpreter requires script")
+	}
+	if t.PokeIntervalSec < 0 || t.SensorTimeoutSec < 0 {
+		return errors.New("negative poke_interval or sensor_timeout")
+	}
+	if t.SensorOnTimeout != "" && t.SensorOnTimeout != "fail" && t.SensorOnTimeout != "skip" {
+		return fmt.Errorf("unknown sensor_on_timeout '%s', expected 'fail' or 'skip'", t.SensorOnTimeout)
+	}
+	return nil
+}
+
+func newSensor(t *Task) *sensor {
+	s := &sensor{
+		pokeInterval: t.PokeIntervalSec,
+		timeout:      t.SensorTimeoutSec,
+		onTimeout:    t.SensorOnTimeout,
+	}
+	if t.SensorCmd != "" {
+		s.kind, s.target = "sensor_cmd", t.SensorCmd
+	} else if t.SensorFile != "" {
+		s.kind, s.target = "sensor_file", t.SensorFile
+	} else if t.SensorHTTP != "" {
+		s.kind, s.target = "sensor_http", t.SensorHTTP
+	} else {
+		return nil
+	}
+	if s.pokeInterval == 0 {
+		s.pokeInterval = 60
+	}
+	if s.onTimeout == "" {
+		s.onTimeout = "fail"
+	}
+	return s
+}
+
+func runSensor(ctx context.Context, tr *TaskRun) error {
+	target, err := renderCmdTemplate(tr, tr.sensor.target)
+	if err != nil {
+		return err
+	}
+	env, err := taskEnv(tr)
+	if err != nil {
+		return err
+	}
+	tr.StartTime = time.Now()
+	tr.Attempt += 1
+	tr.Pokes = 0
+	tr.RenderedCmd = redactSecrets(tr, tr.sensor.kind+": "+target)
+	tr.Status = Waiting
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	sensorCtx, cancelFunc := context.WithCancel(ctx)
+	tr.ctxCancelFn = cancelFunc
+	defer func() {
+		if tr.ctxCancelFn != nil {
+			tr.ctxCancelFn()
+			tr.ctxCancelFn = nil
+		}
+	}()
+	var deadline <-chan time.Time
+	if tr.sensor.timeout > 0 {
+		timer := time.NewTimer(time.Duration(tr.sensor.timeout) * time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(time.Duration(tr.sensor.pokeInterval) * time.Second)
+	defer ticker.Stop()
+	generateEvent("task_waiting", nil, tr)
+	var output strings.Builder
+	err = nil
+poke:
+	for {
+		tr.Pokes += 1
+		ready, msg := pokeSensor(sensorCtx, tr, target, env)
+		fmt.Fprintf(&output, "%s poke %d: %s\n", time.Now().Format(time.RFC3339), tr.Pokes, msg)
+		if ready {
+			break
+		}
+		select {
+		case <-sensorCtx.Done():
+			err = sensorCtx.Err()
+			break poke
+		case <-deadline:
+			err = errSensorTimeout
+			break poke
+		case <-ticker.C:
+		}
+	}
+	tr.EndTime = time.Now()
+	if err == errSensorTimeout && tr.sensor.onTimeout == "skip" {
+		infoLog.Printf("Sensor '%s'-'%s' timed out, skipping\n", tr.jobTitle, tr.Name)
+		output.WriteString("\nSKIPPED: " + err.Error())
+		tr.Status = Skipped
+		err = nil
+	} else if err != nil {
+		errorLog.Printf("Sensor '%s'-'%s' failed: %v\n", tr.jobTitle, tr.Name, err)
+		output.WriteString("\nERROR: " + err.Error())
+		tr.Status = RunFailure
+		notifyTaskFailure(tr)
+	} else {
+		tr.Status = RunSuccess
+	}
+	saveOutputOnDisk(output.String(), tr)
+	generateEvent("task_finished", nil, tr)
+	return err
+}
+
+func pokeSensor(ctx context.Context, tr *TaskRun, target string, env []string) (bool, string) {
+	if tr.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(tr.timeout)*time.Second)
+		defer cancel()
+	}
+	switch kind := tr.sensor.kind; kind {
+	case "sensor_cmd":
+		output, err := newExecutor(tr, nil).Execute(ctx, &execCommand{command: target, dir: tr.Workdir, env: env, limits: tr.limits})
+		if err != nil {
+			return false, fmt.Sprintf("not ready (%v) %s", err, strings.TrimSpace(output))
+		}
+		return true, "ready " + strings.TrimSpace(output)
+	case "sensor_file":
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(tr.Workdir, target)
+		}
+		matches, err := filepath.Glob(target)
+		if err != nil {
+			return false, fmt.Sprintf("bad pattern: %v", err)
+		}
+		if len(matches) == 0 {
+			return false, "no matching files"
+		}
+		return true, "found " + strings.Join(matches, ", ")
+	case "sensor_http":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return false, fmt.Sprintf("bad request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false, fmt.Sprintf("not ready: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return false, "not ready: " + resp.Status
+		}
+		return true, "ready: " + resp.Status
+	}
+	return false, "unknown sensor " + tr.sensor.kind
+}
+
+func saveOutputOnDisk(output string, tr *TaskRun) {
+	if CONF.logsDir == "" {
+		return
+	}
+	output = redactSecrets(tr, output)
+	if err := os.MkdirAll(CONF.logsDir, 0755); err != nil {
+		errorLog.Printf("Failed to create logs directory %s: %v", CONF.logsDir, err)
+		return
+	}
+	tr.Logfile = taskLogfile(tr)
+	filename := filepath.Join(CONF.logsDir, tr.Logfile)
+	if err := os.WriteFile(filename, []byte(output), 0644); err != nil {
+		errorLog.Printf("Failed to write task output to file %s: %v", filename, err)
+	} else {
+		infoLog.Printf("Task output saved to %s", filename)
+	}
+}
+
+func containsInt(s []int, v int) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(s []string, v string) bool {
+	for _, x := range s {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func escapeName(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// taskLogfile names the log of a task attempt. Idx is the index of the item for foreach items,
+// so that attempts and items started in the same second get their own logs.
+func taskLogfile(tr *TaskRun) string {
+	return fmt.Sprintf("%s_%s_%s_%d_%d.log",
+		tr.StartTime.Format("20060102T150405"),
+		escapeName(tr.jobTitle),
+		escapeName(tr.Name),
+		tr.Idx,
+		tr.Attempt,
+	)
+}
+
+func readTaskOutput(tr *TaskRun) (string, error) {
+	if tr.Logfile == "" {
+		return "", nil
+	}
+	filename := filepath.Join(CONF.logsDir, tr.Logfile)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to read logfile %s: %w", tr.Logfile, err)
+	}
+	return string(data), nil
+}
+
+func generateEvent(eventName string, run *JobRun, task *TaskRun) {
+	broadcastSSEUpdate(fmt.Sprintf(`{"event": "%s"}`, eventName))
+	if isLeader() {
+		if task != nil && task.jobRun != nil {
+			snapshotTask(task.jobRun, task)
+			saveRun(task.jobRun)
+		} else if run != nil {
+			snapshotRun(run)
+			saveRun(run)
+		}
+	}
+	// listeners are triggered once per finished run
+	if eventName != "job_finished" || run == nil {
+		return
+	}
+	runJb := jobById(run.jobId)
+	// todo: use channels?
+	if runJb != nil && (run.Status == RunSuccess || run.Status == SuccessWithWarnings) && isLeader() {
+		for _, jb := range loadedJobs() {
+			if len(jb.Listens) == 0 || !jb.OnOff {
+				continue
+			}
+			for _, jobTitle := range jb.Listens {
+				if jobTitle == runJb.Title {
+					infoLog.Printf("Triggering job '%s' on success of '%s'", jb.Title, jobTitle)
+					go runNow(jb, nil)
+					break
+				}
+			}
+		}
+	}
+}
+
+func notifyTaskFailure(tr *TaskRun) {
+	infoLog.Printf("notifyTaskFailure called for job: %s, task: %s", tr.jobTitle, tr.Name)
+	if CONF.notify == "" {
+		return
+	}
+	// todo: simplify
+	const notifyCmdTemplate = `{{.Notify}} --job "{{.Job}}" --task "{{.Task}}" --start "{{.Start}}" --end "{{.End}}" {{if .Emails}}--emails {{range .Emails}}"{{.}}" {{end}}{{end}}`
+	type NotifyParams struct {
+		Notify string
+		Job    string
+		Task   string
+		Start  string
+		End    string
+		Emails []string
+	}
+	data := NotifyParams{
+		Notify: CONF.notify,
+		Job:    tr.jobTitle,
+		Task:   tr.Name,
+		Start:  tr.StartTime.Format(time.RFC3339),
+		End:    tr.EndTime.Format(time.RFC3339),
+		Emails: tr.emails,
+	}
+	tmpl, err := texttemplate.New("notify").Parse(notifyCmdTemplate)
+	if err != nil {
+		errorLog.Printf("Failed to parse notify template: %v", err)
+		return
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		errorLog.Printf("Failed to execute notify template: %v", err)
+		return
+	}
+	//todo: add timeout
+	command := sb.String()
+	infoLog.Printf("Executing notification command: %s", command)
+	cmd := exec.Command("/bin/bash", "-c", command)
+	go func() {
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			errorLog.Printf("Notification script failed: %v, output: %s", err, output)
+		} else {
+			infoLog.Printf("Notification script executed: %s", output)
+		}
+	}()
+}
+
+func restartJobRun(jb *Job, run *JobRun) {
+	run.Status = NoRun
+	run.StartTime = time.Time{}
+	run.EndTime = time.Time{}
+	for _, tr := range run.TasksHistory {
+		tr.Status = NoRun
+		tr.StartTime = time.Time{}
+		tr.EndTime = time.Time{}
+		tr.RenderedCmd = ""
+		tr.Logfile = ""
+		tr.Attempt = 0
+		tr.Pokes = 0
+		tr.Items = nil
+		tr.Attempts = nil
+		tr.Outputs = nil
+	}
+	go runJob(run, jb)
+}
+
+func restartTaskRun(taskRun *TaskRun, jobRun *JobRun) {
+	if !ACTIVERUNS.add(jobRun) {
+		return
+	}
+	go func() {
+		defer ACTIVERUNS.done(jobRun)
+		err := runTask(nil, taskRun)
+		recordAttempt(taskRun, false, "restarted manually")
+		markAllowedFailure(taskRun, err)
+		updateJobRunStatusFromTasks(jobRun)
+		if !isActive(jobRun.Status) {
+			generateEvent("job_finished", jobRun, nil)
+		}
+	}()
+	//todo: add error check
+}
+
+func cancelJobRun(jb *Job, run *JobRun) {
+	for _, tr := range run.TasksHistory {
+		cancelTaskRun(tr, run)
+	}
+	updateJobRunStatusFromTasks(run)
+}
+
+func cancelTaskRun(taskRun *TaskRun, jobRun *JobRun) {
+	if isActive(taskRun.Status) {
+		if taskRun.ctxCancelFn != nil {
+			taskRun.ctxCancelFn()
+			taskRun.ctxCancelFn = nil
+			taskRun.Logfile = ""
+			taskRun.EndTime = time.Time{}
+			taskRun.Status = RunFailure
+		} else {
+			panic("Can't cancel a running task. This is not supposed to happen.")
+		}
+	}
+	generateEvent("task_canceled", nil, taskRun)
+	updateJobRunStatusFromTasks(jobRun)
+}
+
+func isActive(status RunStatus) bool {
+	return status == Running || status == Waiting || status == WaitingRetry
+}
+
+func cancelActiveJobRuns(jb *Job) {
+	jb.OnOff = false
+	for _, run := range jb.RunHistory {
+		if run.Status == Running {
+			cancelJobRun(jb, run)
+		}
+	}
+	jb.NextScheduled = time.Time{}
+}
+
+func updateJobRunStatusFromTasks(jobRun *JobRun) {
+	warn := false
+	for _, tr := range jobRun.TasksHistory {
+		if tr.Status == RunFailure {
+			jobRun.Status = RunFailure
+			return
+		} else if tr.Status == Interrupted {
+			jobRun.Status = Interrupted
+			return
+		} else if isActive(tr.Status) {
+			jobRun.Status = Running
+			return
+		} else if tr.Status == NoRun || tr.Status == UpstreamFailed {
+			jobRun.Status = RunFailure
+			return
+		} else if tr.Status == FailedAllowed {
+			warn = true
+		}
+	}
+	jobRun.Status = RunSuccess
+	if warn {
+		jobRun.Status = SuccessWithWarnings
+	}
+	generateEvent("job_updated", jobRun, nil)
+}
+
+func jobOnOff(jb *Job) error {
+	jb.OnOff = !jb.OnOff
+	if jb.OnOff {
+		jb.NextScheduled = JC.cron.Entry(jb.cronID).Next
+		scanWatchedFiles(jb)
+	} else {
+		jb.NextScheduled = time.Time{}
+	}
+	infoLog.Printf("Toggled state of %s to %v", jb.Title, jb.OnOff)
+	saveJobState(jb)
+	return nil
+}
+
+func runNow(jb *Job, params map[string]interface{}) error {
+	run := initRun(jb, time.Now(), params)
+	go runJob(run, jb)
+	//todo: check for errors
+	return nil
+}
+
+func httpServer() *http.Server {
+	http.HandleFunc("/", httpIndex)
+	http.HandleFunc("/login", httpLogin)
+	http.HandleFunc("/jobs", httpJobs)
+	http.HandleFunc("/events", httpEvents)
+	http.HandleFunc("/onoff", leaderOnly(httpOnOff))
+	http.HandleFunc("/restart", leaderOnly(httpRestart))
+	http.HandleFunc("/cancel", leaderOnly(httpCancel))
+	http.HandleFunc("/runnow", leaderOnly(httpRunNow))
+	http.HandleFunc("/lastoutput", httpLastOutput)
+	http.HandleFunc("/tail", httpTail)
+	http.HandleFunc("/parsingerrors", httpParsingErrors)
+	http.HandleFunc("/jobconfig", httpJobConfig)
+	http.HandleFunc("/api/jobs/", leaderOnly(httpAPIJobs))
+	http.HandleFunc("/api/workers", httpWorkers)
+	http.HandleFunc("/api/workers/", leaderOnly(httpAPIWorkers))
+	return &http.Server{Addr: CONF.port}
+}
+
+// leaderOnly rejects requests that start or change runs on followers and while shutting down.
+func leaderOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ACTIVERUNS.isStopping() {
+			http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+			return
+		} else if !isLeader() {
+			http.Error(w, fmt.Sprintf("Read-only follower, the leader is '%s'", leaderId()), http.StatusServiceUnavailable)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func httpIndex(w http.ResponseWriter, r *http.Request) {
+	data, err := embedded.ReadFile("index.html")
+	if err != nil {
+		http.Error(w, "Error loading the page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(data)
+}
+
+func httpLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	var creds struct {
+		Password string `json:"password"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&creds)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if creds.Password != CONF.password {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	expirationTime := time.Now().Add(15 * time.Minute)
+	claims := jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(expirationTime),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	tokenString, err := token.SignedString(jwtSecretKey)
+	if err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "token",
+		Value:    tokenString,
+		Expires:  expirationTime,
+		HttpOnly: true,
+	})
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Login successful!"))
+}
+
+func httpCheckAuth(w http.ResponseWriter, r *http.Request) (error, int, string) {
+	if CONF.password == "" {
+		return nil, http.StatusOK, "Ok"
+	}
+	cookie, err := r.Cookie("token")
+	if err != nil {
+		if err == http.ErrNoCookie {
+			return err, http.StatusUnauthorized, "Unauthorized"
+		}
+		return err, http.StatusBadRequest, "Bad request"
+	}
+	tokenStr := cookie.Value
+	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
+		return jwtSecretKey, nil
+	})
+	if err != nil || !token.Valid {
+		return err, http.StatusUnauthorized, "Unauthorized"
+	}
+	//todo: prolong token
+	return nil, http.StatusOK, "Ok"
+}
+
+func httpJobs(w http.ResponseWriter, r *http.Request) {
+	err, code, msg := httpCheckAuth(w, r)
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	JC.mu.RLock()
+	jData, err := json.Marshal(&JC)
+	JC.mu.RUnlock()
+	if err != nil {
+		errorLog.Println(err)
+		http.Error(w, "No Jobs Found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jData)
+}
+
+func httpOnOff(w http.ResponseWriter, r *http.Request) {
+	err, code, msg := httpCheckAuth(w, r)
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	job, _, _ := httpParseJobRunTask(r)
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	jobOnOff(job)
+	// todo: w.Write(json.Marshal(JC))
+	w.WriteHeader(http.StatusOK)
+}
+
+func httpRestart(w http.ResponseWriter, r *http.Request) {
+	err, code, msg := httpCheckAuth(w, r)
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	job, run, task := httpParseJobRunTask(r)
+	if run != nil && task != nil {
+		//todo: check concurrency issues
+		go restartTaskRun(task, run)
+	} else if run != nil {
+		go restartJobRun(job, run)
+	} else {
+		http.Error(w, "JobRun or TaskRun not found", http.StatusNotFound)
+		return
+	}
+	// todo: w.Write(json.Marshal(JC))
+	w.WriteHeader(http.StatusOK)
+}
+
+func httpCancel(w http.ResponseWriter, r *http.Request) {
+	err, code, msg := httpCheckAuth(w, r)
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	job, run, task := httpParseJobRunTask(r)
+	if run != nil && task != nil {
+		//todo: check concurrency issues
+		go cancelTaskRun(task, run)
+	} else if run != nil {
+		go cancelJobRun(job, run)
+	} else {
+		http.Error(w, "JobRun or TaskRun not found", http.StatusNotFound)
+		return
+	}
+	// todo: w.Write(json.Marshal(JC))
+	w.WriteHeader(http.StatusOK)
+}
+
+func httpRunNow(w http.ResponseWriter, r *http.Request) {
+	err, code, msg := httpCheckAuth(w, r)
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	job, _, _ := httpParseJobRunTask(r)
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	runNow(job, nil)
+	// todo: w.Write(json.Marshal(JC))
+	w.WriteHeader(http.StatusOK)
+}
+
+func httpLastOutput(w http.ResponseWriter, r *http.Request) {
+	err, code, msg := httpCheckAuth(w, r)
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	task, msg := httpParseTaskItem(r)
+	if task == nil {
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+	var output string
+	output, err = readTaskOutput(task)
+	if err != nil {
+		errorLog.Printf("Failed to read task run log: %v", err)
+		http.Error(w, "ERROR: Failed to read task run log", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(output))
+}
+
+// httpParseTaskItem returns the task run, or its item when item is set, otherwise an error message.
+func httpParseTaskItem(r *http.Request) (*TaskRun, string) {
+	_, _, task := httpParseJobRunTask(r)
+	if task == nil {
+		return nil, "Task not found"
+	}
+	if item_str := r.URL.Query().Get("item"); item_str != "" {
+		item_idx, err := strconv.Atoi(item_str)
+		if err != nil || item_idx < 0 || item_idx >= len(task.Items) {
+			return nil, "Item not found"
+		}
+		task = task.Items[item_idx]
+	}
+	return task, ""
+}
+
+// httpTail streams the log of a task run as server-sent events from offset bytes
+// until the task is no longer active. Event ids are offsets, so reconnecting clients resume where they stopped.
+// A reset event means a new attempt started a new log.
+func httpTail(w http.ResponseWriter, r *http.Request) {
+	err, code, msg := httpCheckAuth(w, r)
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	task, msg := httpParseTaskItem(r)
+	if task == nil {
+		http.Error(w, msg, http.StatusNotFound)
+		return
+	}
+	offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		offset, _ = strconv.ParseInt(id, 10, 64)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	logfile := task.Logfile
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// the status is read first not to miss the end of the output
+		active := isActive(task.Status)
+		if task.Logfile != logfile && task.Logfile != "" {
+			logfile = task.Logfile
+			offset = 0
+			fmt.Fprintf(w, "id: 0\nevent: reset\ndata: {}\n\n")
+		}
+		if data := readLogFrom(logfile, offset); len(data) > 0 {
+			offset += int64(len(data))
+			chunk, _ := json.Marshal(string(data))
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", offset, chunk)
+		}
+		if !active {
+			fmt.Fprintf(w, "event: end\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readLogFrom reads a log file from offset up to the last complete UTF-8 character.
+func readLogFrom(logfile string, offset int64) []byte {
+	if logfile == "" {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(CONF.logsDir, logfile))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil
+	}
+	data, _ := io.ReadAll(f)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				data = data[:i]
+			}
+			break
+		}
+	}
+	return data
+}
+
+func httpParseJobRunTask(r *http.Request) (*Job, *JobRun, *TaskRun) {
+	var jb *Job
+	var run *JobRun
+	var task *TaskRun
+	job_str := r.URL.Query().Get("job")
+	jb_id, err := strconv.Atoi(job_str)
+	if err != nil {
+		return nil, nil, nil
+	}
+	jb = jobById(jb_id)
+	if jb == nil {
+		return nil, nil, nil
+	}
+	run_str := r.URL.Query().Get("run")
+	run_idx, err := strconv.Atoi(run_str)
+	if err != nil || run_idx < 0 || run_idx >= len(jb.RunHistory) {
+		return jb, nil, nil
+	}
+	run = jb.RunHistory[run_idx]
+	task_str := r.URL.Query().Get("task")
+	task_idx, err := strconv.Atoi(task_str)
+	if err != nil || task_idx < 0 || task_idx >= len(run.TasksHistory) {
+		return jb, run, nil
+	}
+	task = run.TasksHistory[task_idx]
+	return jb, run, task
+}
+
+func httpParsingErrors(w http.ResponseWriter, r *http.Request) {
+	err, code, msg := httpCheckAuth(w, r)
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html")
+	//todo: unnecessary conversions?
+	w.Write([]byte(webLogBuf.String()))
+}
+
+// httpJobConfig returns the effective job config, with base files merged in.
+func httpJobConfig(w http.ResponseWriter, r *http.Request) {
+	err, code, msg := httpCheckAuth(w, r)
+	if err != nil {
+		http.Error(w, msg, code)
+		return
+	}
+	job, _, _ := httpParseJobRunTask(r)
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	config := make(map[string]interface{})
+	for k, v := range job.config {
+		config[k] = v
+	}
+	if _, ok := config["webhook_token"]; ok {
+		config["webhook_token"] = "***"
+	}
+	if env, ok := config["env"]; ok {
+		config["env"] = maskEnvConfig(env)
+	}
+	if tasks, ok := config["tasks"].([]map[string]interface{}); ok {
+		maskedTasks := make([]map[string]interface{}, len(tasks))
+		for i, t := range tasks {
+			maskedTasks[i] = make(map[string]interface{}, len(t))
+			for k, v := range t {
+				maskedTasks[i][k] = v
+			}
+			if env, ok := t["env"]; ok {
+				maskedTasks[i]["env"] = maskEnvConfig(env)
+			}
+		}
+		config["tasks"] = maskedTasks
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# %s\n", job.file)
+	for _, f := range job.baseFiles {
+		fmt.Fprintf(&buf, "# extends %s\n", f)
+	}
+	if job.Matrix != nil {
+		fmt.Fprintf(&buf, "# matrix values %v\n", job.Matrix)
+	}
+	if err := toml.NewEncoder(&buf).Encode(config); err != nil {
+		errorLog.Printf("Failed to encode config of '%s': %v", job.Title, err)
+		http.Error(w, "ERROR: Failed to encode job config", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(buf.Bytes())
+}
+
+// maskEnvConfig returns a copy of an env table with values of secret-like names masked.
+func maskEnvConfig(env interface{}) interface{} {
+	table, ok := env.(map[string]interface{})
+	if !ok {
+		return env
+	}
+	masked := make(map[string]interface{}, len(table))
+	for k, v := range table {
+		masked[k] = v
+		if secretEnvName.MatchString(k) {
+			masked[k] = "***"
+		}
+	}
+	return masked
+}
+
+func httpAPIJobs(w http.ResponseWriter, r *http.Request) {
+	// only POST /api/jobs/{title or id}/trigger for now
+	// job ids change on reloads, titles are escaped so they can contain slashes
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), "/api/jobs/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "trigger" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	ref, err := url.PathUnescape(parts[0])
+	if err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	jb := findJobByTitle(ref)
+	if id, err := strconv.Atoi(ref); jb == nil && err == nil {
+		jb = jobById(id)
+	}
+	if jb == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if !httpCheckWebhookToken(r, jb) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	payload := make(map[string]interface{})
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+	status := http.StatusAccepted
+	key := r.Header.Get("Idempotency-Key")
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	run := webhookRunByKey(jb, key)
+	if run != nil {
+		infoLog.Printf("Webhook for '%s' with duplicate idempotency key '%s'", jb.Title, key)
+		status = http.StatusOK
+	} else {
+		infoLog.Printf("Triggering job '%s' by webhook", jb.Title)
+		run = initRun(jb, time.Now(), map[string]interface{}{"payload": payload})
+		if key != "" {
+			addWebhookKey(jb, key, run)
+		}
+		go runJob(run, jb)
+	}
+	resp, _ := json.Marshal(map[string]interface{}{
+		"job":       jb.Title,
+		"run":       run.Idx,
+		"duplicate": status == http.StatusOK,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(resp)
+}
+
+var webhookMu sync.Mutex
+
+// webhookRuns holds the idempotency keys by job title, apart from jobs so that they survive reloads.
+// The leader saves them in the state directory so that they survive restarts and failovers.
+var webhookRuns = make(map[string]map[string]*webhookRun)
+
+func webhookKeysStatePath() string {
+	return filepath.Join(CONF.stateDir, "webhook_keys.json")
+}
+
+func loadWebhookKeys() {
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+	data, err := os.ReadFile(webhookKeysStatePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		errorLog.Printf("Failed to read webhook idempotency keys: %v", err)
+		return
+	}
+	keys := make(map[string]map[string]*webhookRun)
+	if err := json.Unmarshal(data, &keys); err != nil {
+		errorLog.Printf("Failed to parse webhook idempotency keys: %v", err)
+		return
+	}
+	webhookRuns = keys
+}
+
+// addWebhookKey records the run started with the key and drops the oldest keys of the job over the cap.
+// It expects webhookMu to be held.
+func addWebhookKey(jb *Job, key string, run *JobRun) {
+	keys := webhookRuns[jb.Title]
+	if keys == nil {
+		keys = make(map[string]*webhookRun)
+		webhookRuns[jb.Title] = keys
+	}
+	keys[key] = &webhookRun{RunStart: run.StartTime, Created: time.Now()}
+	for len(keys) > maxWebhookKeys {
+		oldest := key
+		for k, wr := range keys {
+			if wr.Created.Before(keys[oldest].Created) {
+				oldest = k
 			}
-			run.TasksHistory = append(run.TasksHistory, &TaskRun{
-				Name:    t.Name,
-				Idx:     idx,
-				cmd:     t.Cmd,
-				Status:  NoRun,
-				Attempt: 0,
-				cmdTemplateParams: map[string]string{
-					"title":        jb.Title,
-					"scheduled_dt": run.ScheduledTime.Format("2006-01-02"),
-				},
-				retries: retries,
-				timeout: timeout,
-				emails:  emails,
-				logfile: "",
-			})
-			idx += 1
 		}
+		delete(keys, oldest)
+	}
+	data, err := json.Marshal(webhookRuns)
+	if err != nil {
+		errorLog.Printf("Failed to serialize webhook idempotency keys: %v", err)
+		return
+	}
+	if err := writeFileAtomic(webhookKeysStatePath(), data); err != nil {
+		errorLog.Printf("Failed to save webhook idempotency keys: %v", err)
 	}
-	jb.RunHistory = append(jb.RunHistory, run)
-	return run
 }
 
-func runJob(run *JobRun, jb *Job) error {
-	//todo: check race conditions
-	ctx, cancel := context.WithCancel(context.Background())
-	run.ctxCancelFn = cancel
-	defer func() {
-		if run.ctxCancelFn != nil {
-			run.ctxCancelFn()
-			run.ctxCancelFn = nil
+func httpCheckWebhookToken(r *http.Request, jb *Job) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return false
+	}
+	for _, t := range []string{jb.WebhookToken, CONF.webhookToken} {
+		if t != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
 		}
-	}()
-	run.Status = Running
-	infoLog.Printf("Running '%s'", jb.Title)
-	generateEvent("job_running", run, nil)
-	var jobFail bool
-	idx := 0
-	for _, parallelGroup := range jb.Order {
-		var wg sync.WaitGroup
-		errCh := make(chan error, len(parallelGroup))
-		for range parallelGroup {
-			tr := run.TasksHistory[idx]
-			wg.Add(1)
-			go func(tr *TaskRun) {
-				defer wg.Done()
-				var lastErr error
-				for attempt := 1; attempt <= tr.retries+1; attempt++ {
-					infoLog.Printf("Running task '%s' (attempt %d/%d)", tr.Name, attempt, tr.retries+1)
-					lastErr = runTask(ctx, tr)
-					if lastErr == nil {
-						break
-					} else if lastErr == context.Canceled {
-						infoLog.Printf("Task '%s' cancelled", tr.Name)
-						break
-					}
-					errorLog.Printf("Task '%s' failed (attempt %d/%d)", tr.Name, attempt, tr.retries+1)
-					if attempt > tr.retries {
-						break
-					}
-				}
-				if lastErr != nil {
-					errCh <- lastErr
-				}
-			}(tr)
-			idx += 1
+	}
+	return false
+}
+
+// webhookRunByKey returns the run previously started with the idempotency key.
+// Keys are kept for a day. It expects webhookMu to be held.
+func webhookRunByKey(jb *Job, key string) *JobRun {
+	for title, keys := range webhookRuns {
+		for k, wr := range keys {
+			if time.Since(wr.Created) > 24*time.Hour {
+				delete(keys, k)
+			}
 		}
-		wg.Wait()
-		close(errCh)
-		if len(errCh) > 0 {
-			jobFail = true
-			break
+		if len(keys) == 0 {
+			delete(webhookRuns, title)
 		}
 	}
-	run.Status = RunSuccess
-	if jobFail {
-		run.Status = RunFailure
+	wr := webhookRuns[jb.Title][key]
+	if key == "" || wr == nil {
+		return nil
+	}
+	for _, run := range jb.RunHistory {
+		if run.StartTime.Equal(wr.RunStart) {
+			return run
+		}
 	}
-	run.EndTime = time.Now()
-	generateEvent("job_finished", run, nil)
-	//todo: return error
 	return nil
 }
 
-func runTask(ctx context.Context, tr *TaskRun) error {
-	tmpl := texttemplate.New("tmpl").Option("missingkey=error")
-	tmpl, err := tmpl.Parse(tr.cmd)
-	if err != nil {
-		errorLog.Printf("Error parsing command template '%s'-'%s'-'%s': %v\n", tr.cmdTemplateParams["title"], tr.Name, tr.cmd, err)
-		return err
+// validateRemote checks that a task runs either on workers or over SSH, and without run_as over SSH.
+func validateRemote(jb *Job, t *Task) error {
+	host, workerLabels, runAs := t.Host, t.WorkerLabels, t.RunAs
+	if host == "" {
+		host = jb.Host
 	}
-	sb := new(strings.Builder)
-	err = tmpl.Execute(sb, tr.cmdTemplateParams)
+	if workerLabels == nil {
+		workerLabels = jb.WorkerLabels
+	}
+	if runAs == "" {
+		runAs = jb.RunAs
+	}
+	if host != "" && workerLabels != nil {
+		return errors.New("host and worker_labels can't be used together")
+	} else if host != "" && runAs != "" {
+		return errors.New("run_as can't be used with host, use ssh_user")
+	}
+	return nil
+}
+
+// sshExecutor runs commands on a remote host.
+// The login shell of the remote user must be a POSIX shell.
+type sshExecutor struct {
+	host   string
+	user   string
+	shell  string
+	config func(sshUser string) (*ssh.ClientConfig, error)
+	dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Execute runs the command in a new SSH connection. On cancellation it kills
+// the remote process group and closes the session.
+func (e *sshExecutor) Execute(ctx context.Context, c *execCommand) (string, error) {
+	config, err := e.config(e.user)
 	if err != nil {
-		errorLog.Printf("Error rendering command template '%s'-'%s'-'%s': %v\n", tr.cmdTemplateParams["title"], tr.Name, tr.cmd, err)
-		return err
+		return "", err
 	}
-	tr.StartTime = time.Now()
-	tr.Attempt += 1
-	tr.RenderedCmd = sb.String()
-	tr.Status = Running
-	//
-	var execCtx context.Context
-	var timeoutFunc context.CancelFunc
-	if ctx == nil {
-		ctx = context.Background()
+	addr := e.host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
 	}
-	cancelCtx, cancelFunc := context.WithCancel(ctx)
-	if tr.timeout > 0 {
-		execCtx, timeoutFunc = context.WithTimeout(cancelCtx, time.Duration(tr.timeout)*time.Second)
-	} else {
-		execCtx = cancelCtx
-		timeoutFunc = func() {}
+	conn, err := e.dial(ctx, "tcp", addr)
+	if err != nil {
+		return "", err
 	}
-	tr.ctxCancelFn = func() {
-		timeoutFunc()
-		cancelFunc()
+	// the handshake doesn't take a context, a stalled server is cut by the deadline or on cancellation
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
 	}
-	defer func() {
-		if tr.ctxCancelFn != nil {
-			tr.ctxCancelFn()
-			tr.ctxCancelFn = nil
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
 		}
 	}()
-	generateEvent("task_running", nil, tr)
-	output, err := executeCmd(execCtx, tr.RenderedCmd)
-	tr.EndTime = time.Now()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	close(handshakeDone)
 	if err != nil {
-		errorLog.Printf("Error executing '%s'-'%s': %v\n", tr.cmdTemplateParams["title"], tr.Name, err)
-		output = output + "\nERROR: " + err.Error()
-		tr.Status = RunFailure
-		notifyTaskFailure(tr)
-	} else {
-		tr.Status = RunSuccess
+		conn.Close()
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		return "", err
 	}
-	saveOutputOnDisk(output, tr)
-	generateEvent("task_finished", nil, tr)
-	return err
-}
-
-func executeCmd(ctx context.Context, command string) (string, error) {
-	cmd := exec.CommandContext(ctx, "/bin/bash", "-c", command)
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Setpgid:   true,
-		Pdeathsig: syscall.SIGKILL,
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	output := &syncBuffer{}
+	var w io.Writer = output
+	if c.output != nil {
+		w = io.MultiWriter(output, c.output)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	session.Stderr = w
+	command, stdin := sshCommand(e.shell, c)
+	session.Stdin = strings.NewReader(stdin)
+	if err := session.Start(command); err != nil {
+		return "", err
 	}
+	pgid := make(chan string, 1)
+	done := make(chan error, 1)
 	go func() {
-		<-ctx.Done()
-		if cmd.Process != nil {
-			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
-		}
+		r := bufio.NewReader(stdout)
+		line, _ := r.ReadString('\n')
+		pgid <- strings.TrimSpace(line)
+		io.Copy(w, r)
+		done <- session.Wait()
 	}()
-	output, err := cmd.CombinedOutput()
-	if ctx.Err() != nil {
-		return string(output), ctx.Err()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		select {
+		case id := <-pgid:
+			if kill, err := client.NewSession(); err == nil && id != "" {
+				kill.Run("kill -9 -" + id)
+				kill.Close()
+			}
+		case <-time.After(time.Second):
+		}
+		session.Close()
+		return output.String(), ctx.Err()
 	}
-	return string(output), err
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		err = &exitStatusError{code: exitErr.ExitStatus(), msg: fmt.Sprintf("exit status %d", exitErr.ExitStatus())}
+	}
+	return output.String(), err
 }
 
-func saveOutputOnDisk(output string, tr *TaskRun) {
-	if CONF.logsDir == "" {
-		return
+// sshCommand returns the remote command and its stdin.
+// The command prints its process group id first, the login shell started by sshd leading the group.
+// Env variables and scripts are sent on stdin to keep them out of remote process lists.
+func sshCommand(shell string, c *execCommand) (string, string) {
+	var sb, stdin strings.Builder
+	sb.WriteString("echo $$; ")
+	for _, kv := range c.env {
+		k, v, _ := strings.Cut(kv, "=")
+		fmt.Fprintf(&stdin, "export %s=%s\n", k, shellQuote(v))
 	}
-	if err := os.MkdirAll(CONF.logsDir, 0755); err != nil {
-		errorLog.Printf("Failed to create logs directory %s: %v", CONF.logsDir, err)
-		return
+	if stdin.Len() > 0 {
+		fmt.Fprintf(&sb, "eval \"$(dd bs=1 count=%d 2>/dev/null)\"; ", stdin.Len())
 	}
-	tr.logfile = fmt.Sprintf("%s_%s_%s.log", //todo: add indexes and attempt
-		tr.StartTime.Format("20060102T150405"),
-		escapeName(tr.cmdTemplateParams["title"]), // todo: use job.Title
-		escapeName(tr.Name),
-	)
-	filename := filepath.Join(CONF.logsDir, tr.logfile)
-	if err := os.WriteFile(filename, []byte(output), 0644); err != nil {
-		errorLog.Printf("Failed to write task output to file %s: %v", filename, err)
+	var prefix string
+	if c.dir != "" {
+		prefix = "cd " + shellQuote(c.dir) + " && "
+	}
+	prefix += ulimitPrefix(c.limits, false)
+	if c.script != "" && len(c.args) > 0 {
+		// the last argument is the script file on the scheduler
+		stdin.WriteString(c.script)
+		args := (&execCommand{args: c.args[:len(c.args)-1]}).String()
+		fmt.Fprintf(&sb, `f=$(mktemp) && cat > "$f" && chmod 700 "$f" && %s{ %s "$f"; }; rc=$?; rm -f "$f"; exit $rc`, prefix, args)
+	} else if c.args != nil {
+		sb.WriteString(prefix + "exec " + c.String())
 	} else {
-		infoLog.Printf("Task output saved to %s", filename)
+		sb.WriteString(prefix + "exec " + shellQuote(shell) + " -c " + shellQuote(c.command))
 	}
+	return sb.String(), stdin.String()
 }
 
-func escapeName(s string) string {
-	var b strings.Builder
-	for _, r := range s {
-		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' {
-			b.WriteRune(r)
-		} else {
-			b.WriteRune('_')
+func sshClientConfig(sshUser string) (*ssh.ClientConfig, error) {
+	if sshUser == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, err
 		}
+		sshUser = u.Username
 	}
-	return b.String()
-}
-
-func readTaskOutput(tr *TaskRun) (string, error) {
-	if tr.logfile == "" {
-		return "", nil
+	key, err := os.ReadFile(CONF.sshKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ssh key: %v", err)
 	}
-	filename := filepath.Join(CONF.logsDir, tr.logfile)
-	data, err := os.ReadFile(filename)
+	signer, err := ssh.ParsePrivateKey(key)
 	if err != nil {
-		return "", fmt.Errorf("failed to read logfile %s: %w", tr.logfile, err)
+		return nil, fmt.Errorf("failed to parse ssh key: %v", err)
 	}
-	return string(data), nil
+	hostKeyCallback, err := knownhosts.New(CONF.sshKnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %v", err)
+	}
+	return &ssh.ClientConfig{
+		User:            sshUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}, nil
 }
 
-func generateEvent(eventName string, run *JobRun, task *TaskRun) {
-	broadcastSSEUpdate(fmt.Sprintf(`{"event": "%s"}`, eventName))
-	// todo: use channels?
-	if run != nil && run.Status == RunSuccess {
-		for _, jb := range JC.Jobs {
-			if len(jb.Listens) == 0 || !jb.OnOff {
-				continue
-			}
-			for _, jobTitle := range jb.Listens {
-				if jobTitle == JC.Jobs[run.jobId].Title {
-					infoLog.Printf("Triggering job '%s' on success of '%s'", jb.Title, jobTitle)
-					go runNow(jb)
-					break
-				}
-			}
-		}
-	}
+const (
+	workerPollTimeout   = 30 * time.Second
+	workerUpdatePeriod  = 5 * time.Second
+	workerLostTimeout   = 30 * time.Second
+	workerRetryInterval = 5 * time.Second
+)
+
+type worker struct {
+	Id       string
+	Labels   map[string]string
+	LastSeen time.Time
+	Running  int
 }
 
-func notifyTaskFailure(tr *TaskRun) {
-	infoLog.Printf("notifyTaskFailure called for job: %s, task: %s", tr.cmdTemplateParams["title"], tr.Name)
-	if CONF.notify == "" {
-		return
-	}
-	// todo: simplify
-	const notifyCmdTemplate = `{{.Notify}} --job "{{.Job}}" --task "{{.Task}}" --start "{{.Start}}" --end "{{.End}}" {{if .Emails}}--emails {{range .Emails}}"{{.}}" {{end}}{{end}}`
-	type NotifyParams struct {
-		Notify string
-		Job    string
-		Task   string
-		Start  string
-		End    string
-		Emails []string
-	}
-	data := NotifyParams{
-		Notify: CONF.notify,
-		Job:    tr.cmdTemplateParams["title"],
-		Task:   tr.Name,
-		Start:  tr.StartTime.Format(time.RFC3339),
-		End:    tr.EndTime.Format(time.RFC3339),
-		Emails: tr.emails,
-	}
-	tmpl, err := texttemplate.New("notify").Parse(notifyCmdTemplate)
-	if err != nil {
-		errorLog.Printf("Failed to parse notify template: %v", err)
-		return
-	}
-	var sb strings.Builder
-	if err := tmpl.Execute(&sb, data); err != nil {
-		errorLog.Printf("Failed to execute notify template: %v", err)
-		return
-	}
-	//todo: add timeout
-	command := sb.String()
-	infoLog.Printf("Executing notification command: %s", command)
-	cmd := exec.Command("/bin/bash", "-c", command)
-	go func() {
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			errorLog.Printf("Notification script failed: %v, output: %s", err, output)
-		} else {
-			infoLog.Printf("Notification script executed: %s", output)
-		}
-	}()
+// workerTask is a command sent to a worker.
+type workerTask struct {
+	Id         string
+	Command    string
+	Args       []string
+	Shell      string
+	Script     string
+	Dir        string
+	Env        []string
+	RunAs      string
+	Memory     int64
+	CPUSeconds uint64
+	Nofile     uint64
+	labels     map[string]string
+	worker     string
+	updated    time.Time
+	output     strings.Builder
+	stream     io.Writer
+	result     chan *workerResult
+	done       bool
 }
 
-func restartJobRun(jb *Job, run *JobRun) {
-	run.Status = NoRun
-	run.StartTime = time.Time{}
-	run.EndTime = time.Time{}
-	for _, tr := range run.TasksHistory {
-		tr.Status = NoRun
-		tr.StartTime = time.Time{}
-		tr.EndTime = time.Time{}
-		tr.RenderedCmd = ""
-		tr.logfile = ""
-		tr.Attempt = 0
-	}
-	go runJob(run, jb)
+// workerResult is sent by workers while running a task and when it's done.
+type workerResult struct {
+	Output        string
+	Done          bool
+	ExitCode      int
+	Error         string
+	FailureReason string
+	Outputs       string
 }
 
-func restartTaskRun(taskRun *TaskRun, jobRun *JobRun) {
-	go func() {
-		runTask(nil, taskRun)
-		updateJobRunStatusFromTasks(jobRun)
-	}()
-	//todo: add error check
+type workerPool struct {
+	workers map[string]*worker
+	pending []*workerTask
+	tasks   map[string]*workerTask
+	changed chan struct{}
+	counter int
+	mu      sync.Mutex
 }
 
-func cancelJobRun(jb *Job, run *JobRun) {
-	for _, tr := range run.TasksHistory {
-		cancelTaskRun(tr, run)
-	}
-	updateJobRunStatusFromTasks(run)
+var WORKERS = &workerPool{
+	workers: make(map[string]*worker),
+	tasks:   make(map[string]*workerTask),
+	changed: make(chan struct{}),
 }
 
-func cancelTaskRun(taskRun *TaskRun, jobRun *JobRun) {
-	if taskRun.Status == Running {
-		if taskRun.ctxCancelFn != nil {
-			taskRun.ctxCancelFn()
-			taskRun.ctxCancelFn = nil
-			taskRun.logfile = ""
-			taskRun.EndTime = time.Time{}
-			taskRun.Status = RunFailure
-		} else {
-			panic("Can't cancel a running task. This is not supposed to happen.")
+// workerExecutor runs commands on workers with matching labels.
+type workerExecutor struct {
+	shell  string
+	labels map[string]string
+}
+
+// Execute queues the command until a worker takes it and waits for the result.
+// A worker that doesn't report for workerLostTimeout fails the command.
+func (e *workerExecutor) Execute(ctx context.Context, c *execCommand) (string, error) {
+	t := &workerTask{
+		Command: c.command,
+		Args:    c.args,
+		Shell:   e.shell,
+		Script:  c.script,
+		Dir:     c.dir,
+		Env:     c.env,
+		labels:  e.labels,
+		stream:  c.output,
+		result:  make(chan *workerResult, 1),
+	}
+	if c.limits != nil {
+		t.RunAs, t.Memory, t.CPUSeconds, t.Nofile = c.limits.runAs, c.limits.memory, c.limits.cpuSeconds, c.limits.nofile
+	}
+	WORKERS.enqueue(t)
+	defer WORKERS.remove(t)
+	ticker := time.NewTicker(workerUpdatePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return WORKERS.output(t), ctx.Err()
+		case res := <-t.result:
+			if c.outputFile != "" && res.Outputs != "" {
+				os.WriteFile(c.outputFile, []byte(res.Outputs), 0600)
+			}
+			return WORKERS.output(t), res.err()
+		case <-ticker.C:
+			if worker, lost := WORKERS.lost(t); lost {
+				return WORKERS.output(t), fmt.Errorf("worker '%s' stopped responding", worker)
+			}
 		}
 	}
-	generateEvent("task_canceled", nil, taskRun)
-	updateJobRunStatusFromTasks(jobRun)
 }
 
-func cancelActiveJobRuns(jb *Job) {
-	jb.OnOff = false
-	for _, run := range jb.RunHistory {
-		if run.Status == Running {
-			cancelJobRun(jb, run)
-		}
+// err returns the error of a command run by a worker.
+func (res *workerResult) err() error {
+	if res.Error == "" {
+		return nil
 	}
-	jb.NextScheduled = time.Time{}
+	var err error = errors.New(res.Error)
+	if res.ExitCode > 0 {
+		err = &exitStatusError{code: res.ExitCode, msg: res.Error}
+	}
+	if res.FailureReason != "" {
+		err = &limitError{reason: res.FailureReason, err: err}
+	}
+	return err
+}
+
+type exitStatusError struct {
+	code int
+	msg  string
+}
+
+func (e *exitStatusError) Error() string {
+	return e.msg
+}
+
+func (e *exitStatusError) ExitCode() int {
+	return e.code
 }
 
-func updateJobRunStatusFromTasks(jobRun *JobRun) {
-	for _, tr := range jobRun.TasksHistory {
-		if tr.Status == RunFailure {
-			jobRun.Status = RunFailure
-			return
-		} else if tr.Status == Running {
-			jobRun.Status = Running
-			return
-		} else if tr.Status == NoRun {
-			jobRun.Status = RunFailure
-			return
+func (p *workerPool) enqueue(t *workerTask) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.counter += 1
+	t.Id = strconv.Itoa(p.counter) + "-" + base64.RawURLEncoding.EncodeToString(generateRandomKey(6))
+	p.pending = append(p.pending, t)
+	p.tasks[t.Id] = t
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *workerPool) remove(t *workerTask) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, pt := range p.pending {
+		if pt == t {
+			p.pending = append(p.pending[:i], p.pending[i+1:]...)
+			break
 		}
 	}
-	jobRun.Status = RunSuccess
-	generateEvent("job_updated", jobRun, nil)
+	delete(p.tasks, t.Id)
+	if w := p.workers[t.worker]; w != nil && w.Running > 0 {
+		w.Running -= 1
+	}
 }
 
-func jobOnOff(jb *Job) error {
-	jb.OnOff = !jb.OnOff
-	if jb.OnOff {
-		jb.NextScheduled = JC.cron.Entry(jb.cronID).Next
-	} else {
-		jb.NextScheduled = time.Time{}
+func (p *workerPool) output(t *workerTask) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t.worker == "" {
+		return ""
 	}
-	infoLog.Printf("Toggled state of %s to %v", jb.Title, jb.OnOff)
-	return nil
+	return "worker " + t.worker + "\n" + t.output.String()
 }
 
-func runNow(jb *Job) error {
-	run := initRun(jb, nil)
-	go runJob(run, jb)
-	//todo: check for errors
-	return nil
+func (p *workerPool) lost(t *workerTask) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return t.worker, t.worker != "" && time.Since(t.updated) > workerLostTimeout
 }
 
-func httpServer() {
-	http.HandleFunc("/", httpIndex)
-	http.HandleFunc("/login", httpLogin)
-	http.HandleFunc("/jobs", httpJobs)
-	http.HandleFunc("/events", httpEvents)
-	http.HandleFunc("/onoff", httpOnOff)
-	http.HandleFunc("/restart", httpRestart)
-	http.HandleFunc("/cancel", httpCancel)
-	http.HandleFunc("/runnow", httpRunNow)
-	http.HandleFunc("/lastoutput", httpLastOutput)
-	http.HandleFunc("/parsingerrors", httpParsingErrors)
-	log.Fatal(http.ListenAndServe(CONF.port, nil))
+func (p *workerPool) register(id string, labels map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.workers[id] = &worker{Id: id, Labels: labels, LastSeen: time.Now()}
+	for wid, w := range p.workers {
+		if time.Since(w.LastSeen) > 2*workerPollTimeout+workerLostTimeout {
+			delete(p.workers, wid)
+		}
+	}
 }
 
-func httpIndex(w http.ResponseWriter, r *http.Request) {
-	data, err := embedded.ReadFile("index.html")
-	if err != nil {
-		http.Error(w, "Error loading the page", http.StatusInternalServerError)
-		return
+// next waits for a pending task matching the worker labels.
+// It returns nil if there is none before the timeout.
+func (p *workerPool) next(ctx context.Context, id string) (*workerTask, bool) {
+	timer := time.NewTimer(workerPollTimeout)
+	defer timer.Stop()
+	for {
+		p.mu.Lock()
+		w := p.workers[id]
+		if w == nil {
+			p.mu.Unlock()
+			return nil, false
+		}
+		w.LastSeen = time.Now()
+		for i, t := range p.pending {
+			if labelsMatch(t.labels, w.Labels) {
+				p.pending = append(p.pending[:i], p.pending[i+1:]...)
+				t.worker = id
+				t.updated = time.Now()
+				if t.stream != nil {
+					io.WriteString(t.stream, "worker "+id+"\n")
+				}
+				w.Running += 1
+				p.mu.Unlock()
+				return t, true
+			}
+		}
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, true
+		case <-ctx.Done():
+			return nil, true
+		}
 	}
-	w.Header().Set("Content-Type", "text/html")
-	w.Write(data)
 }
 
-func httpLogin(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-	var creds struct {
-		Password string `json:"password"`
+// update records output and the result sent by a worker.
+// It returns false if the task is canceled or unknown.
+func (p *workerPool) update(id string, taskId string, res *workerResult) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := p.tasks[taskId]
+	if t == nil || t.worker != id {
+		return false
 	}
-	err := json.NewDecoder(r.Body).Decode(&creds)
-	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
+	if w := p.workers[id]; w != nil {
+		w.LastSeen = time.Now()
 	}
-	if creds.Password != CONF.password {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-		return
+	// a repeated final report, e.g. a retried request, is acknowledged and ignored
+	if t.done {
+		return true
 	}
-	expirationTime := time.Now().Add(15 * time.Minute)
-	claims := jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(expirationTime),
+	t.updated = time.Now()
+	t.output.WriteString(res.Output)
+	if t.stream != nil {
+		io.WriteString(t.stream, res.Output)
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecretKey)
-	if err != nil {
-		http.Error(w, "Failed to create token", http.StatusInternalServerError)
-		return
+	if res.Done {
+		// the only send, into a buffer of one, doesn't block while holding the lock
+		t.done = true
+		t.result <- res
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "token",
-		Value:    tokenString,
-		Expires:  expirationTime,
-		HttpOnly: true,
-	})
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Login successful!"))
+	return true
 }
 
-func httpCheckAuth(w http.ResponseWriter, r *http.Request) (error, int, string) {
-	if CONF.password == "" {
-		return nil, http.StatusOK, "Ok"
-	}
-	cookie, err := r.Cookie("token")
-	if err != nil {
-		if err == http.ErrNoCookie {
-			return err, http.StatusUnauthorized, "Unauthorized"
+func labelsMatch(required map[string]string, labels map[string]string) bool {
+	for k, v := range required {
+		if labels[k] != v {
+			return false
 		}
-		return err, http.StatusBadRequest, "Bad request"
 	}
-	tokenStr := cookie.Value
-	token, err := jwt.Parse(tokenStr, func(t *jwt.Token) (interface{}, error) {
-		return jwtSecretKey, nil
-	})
-	if err != nil || !token.Valid {
-		return err, http.StatusUnauthorized, "Unauthorized"
-	}
-	//todo: prolong token
-	return nil, http.StatusOK, "Ok"
+	return true
 }
 
-func httpJobs(w http.ResponseWriter, r *http.Request) {
+// httpWorkers lists connected workers.
+func httpWorkers(w http.ResponseWriter, r *http.Request) {
 	err, code, msg := httpCheckAuth(w, r)
 	if err != nil {
 		http.Error(w, msg, code)
 		return
 	}
-	jData, err := json.Marshal(JC)
+	WORKERS.mu.Lock()
+	jData, err := json.Marshal(WORKERS.workers)
+	WORKERS.mu.Unlock()
 	if err != nil {
 		errorLog.Println(err)
-		http.Error(w, "No Jobs Found", http.StatusNotFound)
+		http.Error(w, "ERROR: Failed to list workers", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(jData)
 }
 
-func httpOnOff(w http.ResponseWriter, r *http.Request) {
-	err, code, msg := httpCheckAuth(w, r)
-	if err != nil {
-		http.Error(w, msg, code)
+// httpAPIWorkers serves workers:
+// POST /api/workers/{id}/register with labels,
+// POST /api/workers/{id}/poll returning a task or 204 No Content,
+// POST /api/workers/{id}/tasks/{task} with output and result, 404 cancels the task.
+func httpAPIWorkers(w http.ResponseWriter, r *http.Request) {
+	if CONF.workerToken == "" {
+		http.Error(w, "Workers are disabled, set REPEATER_WORKER_TOKEN", http.StatusNotFound)
 		return
 	}
-	job, _, _ := httpParseJobRunTask(r)
-	if job == nil {
-		http.Error(w, "Job not found", http.StatusNotFound)
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(CONF.workerToken)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	jobOnOff(job)
-	// todo: w.Write(json.Marshal(JC))
-	w.WriteHeader(http.StatusOK)
-}
-
-func httpRestart(w http.ResponseWriter, r *http.Request) {
-	err, code, msg := httpCheckAuth(w, r)
-	if err != nil {
-		http.Error(w, msg, code)
+	if r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
-	job, run, task := httpParseJobRunTask(r)
-	if run != nil && task != nil {
-		//todo: check concurrency issues
-		go restartTaskRun(task, run)
-	} else if run != nil {
-		go restartJobRun(job, run)
-	} else {
-		http.Error(w, "JobRun or TaskRun not found", http.StatusNotFound)
-		return
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/workers/"), "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "register":
+		labels := make(map[string]string)
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&labels); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		infoLog.Printf("Worker '%s' registered with labels %v", parts[0], labels)
+		WORKERS.register(parts[0], labels)
+		w.WriteHeader(http.StatusOK)
+	case len(parts) == 2 && parts[1] == "poll":
+		t, ok := WORKERS.next(r.Context(), parts[0])
+		if !ok {
+			http.Error(w, "Worker not registered", http.StatusNotFound)
+			return
+		} else if t == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		jData, _ := json.Marshal(t)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jData)
+	case len(parts) == 3 && parts[1] == "tasks":
+		var res workerResult
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<20)).Decode(&res); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if !WORKERS.update(parts[0], parts[2], &res) {
+			http.Error(w, "Task not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
 	}
-	// todo: w.Write(json.Marshal(JC))
-	w.WriteHeader(http.StatusOK)
 }
 
-func httpCancel(w http.ResponseWriter, r *http.Request) {
-	err, code, msg := httpCheckAuth(w, r)
-	if err != nil {
-		http.Error(w, msg, code)
-		return
+// workerCmd runs the worker mode: it takes tasks from the scheduler and runs them.
+func workerCmd(args []string) int {
+	hostname, _ := os.Hostname()
+	flags := flag.NewFlagSet("worker", flag.ContinueOnError)
+	server := flags.String("server", os.Getenv("REPEATER_SERVER"), "scheduler URL, REPEATER_SERVER")
+	id := flags.String("id", hostname, "worker id")
+	labelsStr := flags.String("labels", "", "comma separated key=value labels")
+	parallel := flags.Int("parallel", 1, "number of tasks run at once")
+	if err := flags.Parse(args); err != nil {
+		return 2
 	}
-	job, run, task := httpParseJobRunTask(r)
-	if run != nil && task != nil {
-		//todo: check concurrency issues
-		go cancelTaskRun(task, run)
-	} else if run != nil {
-		go cancelJobRun(job, run)
-	} else {
-		http.Error(w, "JobRun or TaskRun not found", http.StatusNotFound)
-		return
+	if *server == "" || CONF.workerToken == "" || *id == "" || *parallel < 1 {
+		fmt.Fprintln(os.Stderr, "usage: repeater worker -server URL [-id ID] [-labels k=v,k=v] [-parallel N], with REPEATER_WORKER_TOKEN set")
+		return 2
 	}
-	// todo: w.Write(json.Marshal(JC))
-	w.WriteHeader(http.StatusOK)
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(*labelsStr, ",") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(kv), "="); ok {
+			labels[k] = v
+		} else if kv != "" {
+			fmt.Fprintf(os.Stderr, "bad label '%s', expected key=value\n", kv)
+			return 2
+		}
+	}
+	wc := &workerClient{
+		server: strings.TrimRight(*server, "/") + "/api/workers/" + url.PathEscape(*id),
+		labels: labels,
+		client: &http.Client{Timeout: workerPollTimeout + 30*time.Second},
+	}
+	for wc.register() != nil {
+		time.Sleep(workerRetryInterval)
+	}
+	infoLog.Printf("Worker '%s' connected to %s with labels %v", *id, *server, labels)
+	var wg sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wc.loop()
+		}()
+	}
+	wg.Wait()
+	return 0
 }
 
-func httpRunNow(w http.ResponseWriter, r *http.Request) {
-	err, code, msg := httpCheckAuth(w, r)
+type workerClient struct {
+	server string
+	labels map[string]string
+	client *http.Client
+}
+
+func (wc *workerClient) post(path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
 	if err != nil {
-		http.Error(w, msg, code)
-		return
+		return nil, err
 	}
-	job, _, _ := httpParseJobRunTask(r)
-	if job == nil {
-		http.Error(w, "Job not found", http.StatusNotFound)
-		return
+	req, err := http.NewRequest(http.MethodPost, wc.server+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
 	}
-	runNow(job)
-	// todo: w.Write(json.Marshal(JC))
-	w.WriteHeader(http.StatusOK)
+	req.Header.Set("Authorization", "Bearer "+CONF.workerToken)
+	req.Header.Set("Content-Type", "application/json")
+	return wc.client.Do(req)
 }
 
-func httpLastOutput(w http.ResponseWriter, r *http.Request) {
-	err, code, msg := httpCheckAuth(w, r)
+func (wc *workerClient) register() error {
+	resp, err := wc.post("/register", wc.labels)
 	if err != nil {
-		http.Error(w, msg, code)
-		return
+		errorLog.Printf("Failed to register worker: %v", err)
+		return err
 	}
-	_, _, task := httpParseJobRunTask(r)
-	if task == nil {
-		http.Error(w, "Task not found", http.StatusNotFound)
-		return
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		errorLog.Printf("Failed to register worker: %s", resp.Status)
+		return errors.New(resp.Status)
 	}
-	var output string
-	output, err = readTaskOutput(task)
-	if err != nil {
-		errorLog.Printf("Failed to read task run log: %v", err)
-		http.Error(w, "ERROR: Failed to read task run log", http.StatusInternalServerError)
-		return
+	return nil
+}
+
+// loop polls for tasks and runs them, registering again if the scheduler restarted.
+func (wc *workerClient) loop() {
+	for {
+		resp, err := wc.post("/poll", nil)
+		if err != nil {
+			errorLog.Printf("Failed to poll for tasks: %v", err)
+			time.Sleep(workerRetryInterval)
+			continue
+		}
+		var t workerTask
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&t)
+		case http.StatusNotFound:
+			err = wc.register()
+		case http.StatusNoContent:
+		default:
+			err = errors.New(resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			errorLog.Printf("Failed to poll for tasks: %v", err)
+			time.Sleep(workerRetryInterval)
+		} else if t.Id != "" {
+			wc.run(&t)
+		}
 	}
-	w.Header().Set("Content-Type", "text/html")
-	w.Write([]byte(output))
 }
 
-func httpParseJobRunTask(r *http.Request) (*Job, *JobRun, *TaskRun) {
-	var jb *Job
-	var run *JobRun
-	var task *TaskRun
-	job_str := r.URL.Query().Get("job")
-	jb_id, err := strconv.Atoi(job_str)
-	if err != nil {
-		return nil, nil, nil
+// run executes a task and sends its output every workerUpdatePeriod and the result at the end.
+// The task is canceled if the scheduler doesn't know it anymore.
+func (wc *workerClient) run(t *workerTask) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := &syncBuffer{}
+	c := &execCommand{command: t.Command, args: t.Args, dir: t.Dir, env: t.Env, output: out}
+	infoLog.Printf("Running task %s: %s", t.Id, c)
+	if t.RunAs != "" || t.Memory > 0 || t.CPUSeconds > 0 || t.Nofile > 0 {
+		c.limits = &procLimits{runAs: t.RunAs, memory: t.Memory, cpuSeconds: t.CPUSeconds, nofile: t.Nofile}
 	}
-	jb = JC.Jobs[jb_id]
-	if jb == nil {
-		return nil, nil, nil
+	res := &workerResult{Done: true}
+	var err error
+	if t.Script != "" && len(c.args) > 0 {
+		// the last argument is the script file on the scheduler
+		tr := &TaskRun{limits: c.limits}
+		var scriptFile string
+		if scriptFile, err = writeScript(tr, t.Script); err == nil {
+			defer os.Remove(scriptFile)
+			c.args[len(c.args)-1] = scriptFile
+			c.command = c.String()
+		}
 	}
-	run_str := r.URL.Query().Get("run")
-	run_idx, err := strconv.Atoi(run_str)
-	if err != nil || run_idx < 0 || run_idx >= len(jb.RunHistory) {
-		return jb, nil, nil
+	if f, ferr := os.CreateTemp("", "repeater_output_*"); ferr == nil {
+		f.Close()
+		c.outputFile = f.Name()
+		defer os.Remove(c.outputFile)
+		chownRunAs(&TaskRun{limits: c.limits}, c.outputFile)
 	}
-	run = jb.RunHistory[run_idx]
-	task_str := r.URL.Query().Get("task")
-	task_idx, err := strconv.Atoi(task_str)
-	if err != nil || task_idx < 0 || task_idx >= len(run.TasksHistory) {
-		return jb, run, nil
+	done := make(chan struct{})
+	if err == nil {
+		go func() {
+			defer close(done)
+			_, err = newExecutor(&TaskRun{shell: t.Shell}, c.args).Execute(ctx, c)
+		}()
+	} else {
+		close(done)
 	}
-	task = run.TasksHistory[task_idx]
-	return jb, run, task
-}
-
-func httpParsingErrors(w http.ResponseWriter, r *http.Request) {
-	err, code, msg := httpCheckAuth(w, r)
+	ticker := time.NewTicker(workerUpdatePeriod)
+	defer ticker.Stop()
+	sent := 0
+wait:
+	for {
+		select {
+		case <-done:
+			break wait
+		case <-ticker.C:
+		}
+		output := out.String()
+		resp, perr := wc.post("/tasks/"+t.Id, &workerResult{Output: output[sent:]})
+		if perr != nil {
+			errorLog.Printf("Failed to send output of task %s: %v", t.Id, perr)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			infoLog.Printf("Task %s canceled", t.Id)
+			cancel()
+		}
+		sent = len(output)
+	}
+	res.Output = out.String()[sent:]
+	res.ExitCode = exitCode(err)
 	if err != nil {
-		http.Error(w, msg, code)
-		return
+		res.Error = err.Error()
+		var limitErr *limitError
+		if errors.As(err, &limitErr) {
+			res.FailureReason = limitErr.reason
+			res.Error = limitErr.err.Error()
+		}
 	}
-	w.Header().Set("Content-Type", "text/html")
-	//todo: unnecessary conversions?
-	w.Write([]byte(webLogBuf.String()))
+	if c.outputFile != "" {
+		outputs, _ := os.ReadFile(c.outputFile)
+		res.Outputs = string(outputs)
+	}
+	for i := 0; i < 3; i++ {
+		resp, perr := wc.post("/tasks/"+t.Id, res)
+		if perr == nil {
+			resp.Body.Close()
+			break
+		}
+		errorLog.Printf("Failed to send result of task %s: %v", t.Id, perr)
+		time.Sleep(workerRetryInterval)
+	}
+	infoLog.Printf("Task %s finished: %v", t.Id, err)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
 }
 
 type sseClients struct {
@@ -1042,8 +5889,20 @@ func addSSEClient(ch chan string) {
 func removeSSEClient(ch chan string) {
 	SSECLIENTS.mu.Lock()
 	defer SSECLIENTS.mu.Unlock()
-	delete(SSECLIENTS.clients, ch)
-	close(ch)
+	if SSECLIENTS.clients[ch] {
+		delete(SSECLIENTS.clients, ch)
+		close(ch)
+	}
+}
+
+// closeSSEClients ends the event streams after the events already queued.
+func closeSSEClients() {
+	SSECLIENTS.mu.Lock()
+	defer SSECLIENTS.mu.Unlock()
+	for ch := range SSECLIENTS.clients {
+		delete(SSECLIENTS.clients, ch)
+		close(ch)
+	}
 }
 
 func broadcastSSEUpdate(msg string) {
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer runs exec requests with /bin/sh in new process groups, like sshd does with login shells.
+type testSSHServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	wg       sync.WaitGroup
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testSSHServer{listener: listener, hostKey: hostKey}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+	srv.wg.Add(1)
+	go func() {
+		defer srv.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			srv.wg.Add(1)
+			go func() {
+				defer srv.wg.Done()
+				srv.serve(conn, config)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		srv.wg.Wait()
+	})
+	return srv
+}
+
+func (srv *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		srv.wg.Add(1)
+		go func() {
+			defer srv.wg.Done()
+			defer ch.Close()
+			for req := range requests {
+				var payload struct{ Command string }
+				if req.Type != "exec" || ssh.Unmarshal(req.Payload, &payload) != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				cmd := exec.Command("/bin/sh", "-c", payload.Command)
+				cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+				cmd.Stdin = ch
+				cmd.Stdout = ch
+				cmd.Stderr = ch.Stderr()
+				code := 255
+				if err := cmd.Run(); err == nil {
+					code = 0
+				} else if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() >= 0 {
+					code = exitErr.ExitCode()
+				}
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+				return
+			}
+		}()
+	}
+}
+
+// executor returns an SSH executor for the host "remote" connected to the test server.
+func (srv *testSSHServer) executor() *sshExecutor {
+	return &sshExecutor{
+		host:  "remote",
+		shell: "/bin/sh",
+		config: func(sshUser string) (*ssh.ClientConfig, error) {
+			return &ssh.ClientConfig{
+				User:            "test",
+				HostKeyCallback: ssh.FixedHostKey(srv.hostKey.PublicKey()),
+				Timeout:         5 * time.Second,
+			}, nil
+		},
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr != "remote:22" {
+				return nil, errors.New("unexpected address " + addr)
+			}
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, srv.listener.Addr().String())
+		},
+	}
+}
+
+// notifyWriter signals when the written output contains a string.
+type notifyWriter struct {
+	syncBuffer
+	want string
+	seen chan struct{}
+	once sync.Once
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	n, err := w.syncBuffer.Write(p)
+	if strings.Contains(w.String(), w.want) {
+		w.once.Do(func() { close(w.seen) })
+	}
+	return n, err
+}
+
+func TestSSHExecutorStreamsOutput(t *testing.T) {
+	srv := newTestSSHServer(t)
+	stream := &notifyWriter{want: "first", seen: make(chan struct{})}
+	c := &execCommand{
+		command: `echo first; echo "$GREETING"; sleep 1; echo last >&2`,
+		env:     []string{"GREETING=hello 'world'"},
+		output:  stream,
+	}
+	type result struct {
+		output string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := srv.executor().Execute(context.Background(), c)
+		done <- result{output, err}
+	}()
+	select {
+	case <-stream.seen:
+	case res := <-done:
+		t.Fatalf("command finished before its output was streamed: %q, %v", res.output, res.err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output streamed")
+	}
+	select {
+	case res := <-done:
+		t.Fatalf("command finished too early: %q, %v", res.output, res.err)
+	default:
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	want := "first\nhello 'world'\nlast\n"
+	if res.output != want || stream.String() != want {
+		t.Errorf("output %q, streamed %q, want %q", res.output, stream.String(), want)
+	}
+}
+
+func TestSSHExecutorExitCode(t *testing.T) {
+	srv := newTestSSHServer(t)
+	output, err := srv.executor().Execute(context.Background(), &execCommand{command: "echo failing; exit 3"})
+	if output != "failing\n" {
+		t.Errorf("output %q", output)
+	}
+	if err == nil || err.Error() != "exit status 3" || exitCode(err) != 3 {
+		t.Errorf("error %v, exit code %d, want exit status 3", err, exitCode(err))
+	}
+}
+
+func TestSSHExecutorCancelKillsProcessGroup(t *testing.T) {
+	srv := newTestSSHServer(t)
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	c := &execCommand{
+		// the background process stays in the group of the shell
+		command: "sleep 30 & echo $! > " + shellQuote(pidFile) + "; echo started; wait",
+		output:  &notifyWriter{want: "started", seen: make(chan struct{})},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := srv.executor().Execute(ctx, c)
+		done <- err
+	}()
+	select {
+	case <-c.output.(*notifyWriter).seen:
+	case err := <-done:
+		t.Fatalf("command finished before it was cancelled: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("command didn't start")
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled command didn't return")
+	}
+	for deadline := time.Now().Add(5 * time.Second); processAlive(pid); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("process %d of the cancelled command is still running", pid)
+		}
+	}
+}
+
+// processAlive reports whether the process exists and is not a zombie.
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	i := strings.LastIndexByte(string(stat), ')')
+	return i < 0 || !strings.HasPrefix(string(stat[i+1:]), " Z")
+}
+
+// testLogs sends the logs to the returned buffer.
+func testLogs() *syncBuffer {
+	logs := &syncBuffer{}
+	infoLog = log.New(logs, "INFO: ", 0)
+	errorLog = log.New(logs, "ERROR: ", 0)
+	webLog = log.New(io.Discard, "", 0)
+	return logs
+}
+
+// writeTestFiles writes files relative to dir.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// loadTestJobs loads job files into a new JC with the logs and the state in a temporary directory.
+// It returns the logs.
+func loadTestJobs(t *testing.T, files map[string]string) *syncBuffer {
+	logs := testLogs()
+	dir := t.TempDir()
+	CONF = Config{
+		jobsDir:  filepath.Join(dir, "jobs"),
+		logsDir:  filepath.Join(dir, "logs"),
+		stateDir: filepath.Join(dir, "state"),
+	}
+	if err := os.Mkdir(CONF.jobsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, CONF.jobsDir, files)
+	JC = JobsAndCron{
+		Jobs:   make(map[int]*Job),
+		parser: cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow),
+	}
+	JC.cron = cron.New(cron.WithParser(JC.parser))
+	scanAndScheduleJobs()
+	return logs
+}
+
+// waitRuns waits for the runs started so far, including the ones that are about to start.
+func waitRuns(t *testing.T, logs *syncBuffer, started func(log string) bool) {
+	for deadline := time.Now().Add(10 * time.Second); !started(logs.String()); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("runs didn't start:\n%s", logs.String())
+		}
+	}
+	if !ACTIVERUNS.wait(10*time.Second, nil) {
+		t.Fatal("runs didn't finish")
+	}
+}
+
+func TestListenerTriggeredOncePerFinishedRun(t *testing.T) {
+	logs := loadTestJobs(t, map[string]string{
+		"source.job": `
+title = "source"
+
+[[tasks]]
+name = "first"
+cmd = "true"
+
+[[tasks]]
+name = "second"
+cmd = "true"
+`,
+		"listener.job": `
+title = "listener"
+listens = ["source"]
+
+[[tasks]]
+name = "echo"
+cmd = "true"
+`,
+	})
+	source, listener := findJobByTitle("source"), findJobByTitle("listener")
+	if source == nil || listener == nil {
+		t.Fatalf("jobs not loaded:\n%s", logs.String())
+	}
+	listener.OnOff = true
+	triggers := func(log string) int {
+		return strings.Count(log, "Triggering job 'listener'")
+	}
+	listenerRuns := func(n int) func(log string) bool {
+		return func(log string) bool { return strings.Count(log, "Running 'listener'") >= n }
+	}
+	run := initRun(source, time.Now(), nil)
+	runJob(run, source)
+	waitRuns(t, logs, listenerRuns(1))
+	if n := triggers(logs.String()); n != 1 {
+		t.Fatalf("listener triggered %d times by a run, want 1", n)
+	}
+	restartTaskRun(run.TasksHistory[1], run)
+	waitRuns(t, logs, listenerRuns(2))
+	if n := triggers(logs.String()); n != 2 {
+		t.Errorf("listener triggered %d times by a run and a restarted task, want 2", n)
+	}
+}
+
+func TestProcessJobFileExtends(t *testing.T) {
+	testLogs()
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"base/common.toml": `
+retries = 2
+emails = ["base@example.com"]
+
+[env]
+A = "1"
+B = "2"
+
+[[tasks]]
+name = "base_task"
+cmd = "true"
+`,
+		"child.job": `
+extends = "base/common.toml"
+title = "child"
+emails = ["child@example.com"]
+
+[env]
+B = "3"
+
+[[tasks]]
+name = "own"
+cmd = "true"
+`,
+		"bad.job": `extends = "base/common.toml"
+title = "bad"
+
+[[tasks]]
+name = "own"
+cmd = "true"
+
+retries = "three"
+`,
+	})
+	jobs, err := processJobFile(filepath.Join(dir, "child.job"))
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("jobs %v, error %v", jobs, err)
+	}
+	jb := jobs[0]
+	if jb.Retries != 2 || strings.Join(jb.Emails, ",") != "child@example.com" || jb.Env["A"] != "1" || jb.Env["B"] != "3" {
+		t.Errorf("retries %d, emails %v, env %v", jb.Retries, jb.Emails, jb.Env)
+	}
+	if len(jb.Tasks) != 1 || jb.Tasks[0].Name != "own" {
+		t.Errorf("tasks of the base weren't replaced: %v", jb.Tasks)
+	}
+	// errors point at the line of the file with the bad value
+	_, err = processJobFile(filepath.Join(dir, "bad.job"))
+	if err == nil || !strings.Contains(err.Error(), "line 8") {
+		t.Errorf("error %v, want one on line 8", err)
+	}
+}
+
+func TestUpstreamOutputs(t *testing.T) {
+	logs := loadTestJobs(t, map[string]string{
+		"outputs.job": `
+title = "outputs"
+order = [["extract"], ["each", "sibling"], ["load"]]
+
+[[tasks]]
+name = "extract"
+cmd = "echo ::set rows=3"
+
+[[tasks]]
+name = "each"
+foreach = ["1", "2", "3", "4", "5", "6", "7", "8"]
+cmd = "echo rows={{.outputs.extract.rows}} upstream={{len .outputs}}"
+
+[[tasks]]
+name = "sibling"
+cmd = "echo ::set s=1"
+
+[[tasks]]
+name = "load"
+cmd = "echo {{.outputs.extract.rows}} {{.outputs.sibling.s}}"
+`,
+	})
+	jb := findJobByTitle("outputs")
+	if jb == nil {
+		t.Fatalf("job not loaded:\n%s", logs.String())
+	}
+	run := initRun(jb, time.Now(), nil)
+	runJob(run, jb)
+	if run.Status != RunSuccess {
+		t.Fatalf("run status %s:\n%s", statusName(run.Status), logs.String())
+	}
+	// items of a task in the group of sibling don't see its outputs
+	for _, item := range run.TasksHistory[1].Items {
+		if item.RenderedCmd != "echo rows=3 upstream=1" {
+			t.Errorf("item %s rendered %q", item.Item, item.RenderedCmd)
+		}
+	}
+	if cmd := run.TasksHistory[3].RenderedCmd; cmd != "echo 3 1" {
+		t.Errorf("load rendered %q", cmd)
+	}
+}
+
+// stalledExecutor returns an SSH executor connected to a server that accepts connections and never answers.
+func stalledExecutor(t *testing.T, timeout time.Duration) *sshExecutor {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return &sshExecutor{
+		host:  "remote",
+		shell: "/bin/sh",
+		config: func(sshUser string) (*ssh.ClientConfig, error) {
+			return &ssh.ClientConfig{User: "test", HostKeyCallback: ssh.InsecureIgnoreHostKey(), Timeout: timeout}, nil
+		},
+		dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, listener.Addr().String())
+		},
+	}
+}
+
+// executeWithin fails the test if the command doesn't return in time.
+func executeWithin(t *testing.T, e *sshExecutor, ctx context.Context, d time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := e.Execute(ctx, &execCommand{command: "true"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		t.Fatal("command didn't return")
+		return nil
+	}
+}
+
+func TestSSHExecutorHandshakeTimeout(t *testing.T) {
+	err := executeWithin(t, stalledExecutor(t, 200*time.Millisecond), context.Background(), 5*time.Second)
+	if err == nil {
+		t.Error("no error from a server that doesn't answer")
+	}
+}
+
+func TestSSHExecutorCancelDuringHandshake(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	err := executeWithin(t, stalledExecutor(t, time.Minute), ctx, 5*time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWorkerPoolRepeatedFinalReport(t *testing.T) {
+	p := &workerPool{
+		workers: make(map[string]*worker),
+		tasks:   make(map[string]*workerTask),
+		changed: make(chan struct{}),
+	}
+	task := &workerTask{worker: "w1", result: make(chan *workerResult, 1)}
+	p.tasks["1"] = task
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// a worker retrying its request after the response was lost
+		for i := 0; i < 3; i++ {
+			if !p.update("w1", "1", &workerResult{Output: "out\n", Done: true}) {
+				t.Error("report rejected")
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("repeated report blocked")
+	}
+	if len(task.result) != 1 || task.output.String() != "out\n" {
+		t.Errorf("%d results, output %q", len(task.result), task.output.String())
+	}
+}
+
+func TestBranchOutcomeMatchingNoBranch(t *testing.T) {
+	job := `
+title = "%s"
+
+[[tasks]]
+name = "check"
+cmd = "echo ::branch typo"
+branches = {%s}
+
+[[tasks]]
+name = "load"
+cmd = "true"
+depends_on = ["check"]
+
+[[tasks]]
+name = "notice"
+cmd = "true"
+depends_on = ["check"]
+`
+	logs := loadTestJobs(t, map[string]string{
+		"strict.job":   fmt.Sprintf(job, "strict", `"new" = ["load"], "none" = ["notice"]`),
+		"fallback.job": fmt.Sprintf(job, "fallback", `"new" = ["load"], "default" = ["notice"]`),
+	})
+	tests := []struct {
+		job    string
+		status []RunStatus
+	}{
+		{"strict", []RunStatus{RunFailure, UpstreamFailed, UpstreamFailed}},
+		{"fallback", []RunStatus{RunSuccess, Skipped, RunSuccess}},
+	}
+	for _, tt := range tests {
+		jb := findJobByTitle(tt.job)
+		if jb == nil {
+			t.Fatalf("job not loaded:\n%s", logs.String())
+		}
+		run := initRun(jb, time.Now(), nil)
+		runJob(run, jb)
+		for i, tr := range run.TasksHistory {
+			if tr.Status != tt.status[i] {
+				t.Errorf("%s: task '%s' %s, want %s", tt.job, tr.Name, statusName(tr.Status), statusName(tt.status[i]))
+			}
+		}
+	}
+}
+
+// testJob builds a job of tasks with the dependencies and the order given, as processJobConfig does.
+func testJob(names []string, dependsOn map[string][]string, order [][]string) *Job {
+	jb := &Job{Order: order, OrderProvided: order != nil, taskMap: make(map[string]*Task)}
+	for _, name := range names {
+		t := &Task{Name: name, DependsOn: dependsOn[name]}
+		jb.Tasks = append(jb.Tasks, t)
+		jb.taskMap[name] = t
+		if order == nil {
+			jb.Order = append(jb.Order, []string{name})
+		}
+	}
+	return jb
+}
+
+func TestBuildTaskDeps(t *testing.T) {
+	abc := []string{"a", "b", "c"}
+	tests := []struct {
+		name      string
+		dependsOn map[string][]string
+		order     [][]string
+		deps      string
+		err       string
+	}{
+		{"sequential by default", nil, nil, "[[] [0] [1]]", ""},
+		{"order groups", nil, [][]string{{"a", "b"}, {"c"}}, "[[] [] [0 1]]", ""},
+		{"depends_on", map[string][]string{"b": {"a"}, "c": {"a"}}, nil, "[[] [0] [0]]", ""},
+		{"depends_on with order", map[string][]string{"c": {"a"}}, [][]string{{"a"}, {"b"}, {"c"}}, "[[] [0] [1 0]]", ""},
+		{"undefined dependency", map[string][]string{"b": {"x"}}, nil, "", "depends on undefined task 'x'"},
+		{"self dependency", map[string][]string{"b": {"b"}}, nil, "", "depends on itself"},
+		{"cycle", map[string][]string{"a": {"c"}, "b": {"a"}, "c": {"b"}}, nil, "", "dependency cycle"},
+		{"dependency on a later group", map[string][]string{"a": {"c"}}, [][]string{{"a"}, {"b"}, {"c"}}, "", "dependency cycle"},
+		{"task twice in order", map[string][]string{"b": {"a"}}, [][]string{{"a"}, {"b"}, {"c", "a"}}, "", "appears in order more than once"},
+	}
+	for _, tt := range tests {
+		jb := testJob(abc, tt.dependsOn, tt.order)
+		err := buildTaskDeps(jb)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if deps := fmt.Sprint(jb.taskDeps); deps != tt.deps {
+			t.Errorf("%s: deps %s, want %s", tt.name, deps, tt.deps)
+		}
+	}
+}
+
+func TestCheckTriggerRule(t *testing.T) {
+	tests := []struct {
+		rule   string
+		deps   []RunStatus
+		run    bool
+		status RunStatus
+	}{
+		{"", []RunStatus{RunSuccess, FailedAllowed}, true, NoRun},
+		{"all_success", []RunStatus{RunSuccess, RunFailure}, false, UpstreamFailed},
+		{"all_success", []RunStatus{RunSuccess, Skipped}, false, Skipped},
+		{"all_success", []RunStatus{UpstreamFailed}, false, UpstreamFailed},
+		{"all_done", []RunStatus{RunFailure, Skipped}, true, NoRun},
+		{"one_failed", []RunStatus{RunSuccess, RunFailure}, true, NoRun},
+		{"one_failed", []RunStatus{RunSuccess, Skipped}, false, Skipped},
+		{"one_failed", nil, true, NoRun},
+		{"all_failed", []RunStatus{RunFailure, UpstreamFailed}, true, NoRun},
+		{"all_failed", []RunStatus{RunFailure, RunSuccess}, false, UpstreamFailed},
+		{"all_failed", []RunStatus{Skipped}, false, Skipped},
+		{"none_failed", []RunStatus{RunSuccess, Skipped}, true, NoRun},
+		{"none_failed", []RunStatus{RunSuccess, Interrupted}, false, UpstreamFailed},
+	}
+	for _, tt := range tests {
+		run, status := checkTriggerRule(tt.rule, tt.deps)
+		if run != tt.run || status != tt.status {
+			t.Errorf("%q with %v: %v, %s, want %v, %s", tt.rule, tt.deps, run, statusName(status), tt.run, statusName(tt.status))
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		delay, maxDelay int
+		backoff         float64
+		attempt         int
+		want            time.Duration
+	}{
+		{10, 0, 0, 3, 10 * time.Second},
+		{10, 0, 2, 1, 10 * time.Second},
+		{10, 0, 2, 3, 40 * time.Second},
+		{10, 0, 1.5, 2, 15 * time.Second},
+		{10, 300, 2, 10, 300 * time.Second},
+		{10, 0, 2, 100, time.Duration(math.MaxInt64)},
+		{0, 0, 2, 5, 0},
+	}
+	for _, tt := range tests {
+		tr := &TaskRun{retryDelay: tt.delay, retryBackoff: tt.backoff, maxRetryDelay: tt.maxDelay}
+		if got := retryDelay(tr, tt.attempt); got != tt.want {
+			t.Errorf("delay %d, backoff %v, max %d, attempt %d: %v, want %v", tt.delay, tt.backoff, tt.maxDelay, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestRetryDecision(t *testing.T) {
+	failed := errors.New("exit status 1")
+	tests := []struct {
+		name     string
+		task     Task
+		err      error
+		attempt  int
+		exitCode int
+		output   string
+		retry    bool
+	}{
+		{"succeeded", Task{}, nil, 1, 0, "", false},
+		{"cancelled", Task{}, context.Canceled, 1, 0, "", false},
+		{"no retries left", Task{}, failed, 3, 1, "", false},
+		{"no conditions", Task{}, failed, 1, 1, "", true},
+		{"exit code to retry", Task{RetryOnExitCodes: []int{75}}, failed, 1, 75, "", true},
+		{"other exit code", Task{RetryOnExitCodes: []int{75}}, failed, 1, 1, "", false},
+		{"output to retry", Task{RetryOnOutput: "(?i)timed? ?out"}, failed, 1, 1, "Connection timed out", true},
+		{"exit code or output", Task{RetryOnExitCodes: []int{75}, RetryOnOutput: "429"}, failed, 1, 1, "HTTP 429", true},
+		{"only no_retry_on conditions", Task{NoRetryOnExitCodes: []int{2}}, failed, 1, 1, "", true},
+		{"no_retry_on_exit_codes first", Task{RetryOnExitCodes: []int{2}, NoRetryOnExitCodes: []int{2}}, failed, 1, 2, "", false},
+		{"no_retry_on_output first", Task{RetryOnOutput: "timeout", NoRetryOnOutput: "SyntaxError"}, failed, 1, 1, "timeout\nSyntaxError", false},
+		{"no_retry_on_output over exit codes", Task{RetryOnExitCodes: []int{1}, NoRetryOnOutput: "SyntaxError"}, failed, 1, 1, "SyntaxError", false},
+	}
+	for _, tt := range tests {
+		retryOn, err := newRetryConditions(&tt.task)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		tr := &TaskRun{retries: 2, retryOn: retryOn, ExitCode: tt.exitCode, output: tt.output}
+		if retry, reason := retryDecision(tr, tt.err, tt.attempt); retry != tt.retry {
+			t.Errorf("%s: retry %v (%s), want %v", tt.name, retry, reason, tt.retry)
+		}
+	}
+}